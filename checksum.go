@@ -0,0 +1,28 @@
+package rudp
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+)
+
+// with FEATURE_CHECKSUM every package ends with the crc32c of the bytes
+// before,Input drops a package that does not match before parsing it.
+// Like the packet head it is not counted in the package size.
+const CHECKSUM_SIZE = 4
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+func appendChecksum(bts []byte) []byte {
+	var sum [CHECKSUM_SIZE]byte
+	binary.BigEndian.PutUint32(sum[:], crc32.Checksum(bts, castagnoli))
+	return append(bts, sum[:]...)
+}
+
+// verifyChecksum returns bts without the checksum,false if it does not match.
+func verifyChecksum(bts []byte) ([]byte, bool) {
+	n := len(bts) - CHECKSUM_SIZE
+	if n < 0 || binary.BigEndian.Uint32(bts[n:]) != crc32.Checksum(bts[:n], castagnoli) {
+		return nil, false
+	}
+	return bts[:n], true
+}
@@ -2,24 +2,59 @@ package rudp
 
 import "time"
 
-//rudp
-var corruptTick int = 5
-var expiredTick int = 1e2 * 60 * 5 //5 minute on sendTick 1e7
-var sendDelayTick int = 1
-var missingTime int = 1e7
+// Config holds the settings of a Rudp and of the RudpConn running it. It is
+// copied when passed to New or NewListener, start from DefaultConfig and
+// change what is needed.
+type Config struct {
+	//rudp
+	CorruptTick    int //corrupt if nothing received in n tick
+	ExpiredTick    int //sent messages are kept n tick for sending again
+	SendDelayTick  int //output messages every n tick
+	MissingTime    int //request a missing message after n nanosecond,until rtt is measured
+	ResendTime     int //send again a message not acknowledged in n nanosecond,until rtt is measured
+	MaxMessageSize int //max size of a reassembled message
+	Window         int //receive window in message,also the buffer size of RudpConn,max 0xffff
+	MaxResendSize  int //bytes sent again on requests and timeouts every TIME_INTERVAL
+	MaxPacketSize  int //largest package path mtu discovery probes,GENERAL_PACKAGE or less disable it
+	Version        int //highest protocol version offered in the handshake
+	Features       int //protocol features offered in the handshake
 
-func SetCorruptTick(tick int)   { corruptTick = tick }
-func SetExpiredTick(tick int)   { expiredTick = tick }
-func SetSendDelayTick(tick int) { sendDelayTick = tick }
-func SetMissingTime(miss int)   { missingTime = miss }
+	//creates the congestion controller of each Rudp,nil disable it
+	Congestion func() Congestion
 
-//rudp conn
-var debug bool = false
-var autoSend bool = true
-var sendTick time.Duration = 1e7
-var maxSendNumPerTick int = 500
+	//rudp conn
+	Debug             bool
+	AutoSend          bool          //update rudp by a ticker
+	SendTick          time.Duration //ticker interval,0 disable auto send
+	MaxSendNumPerTick int
+	StreamMode        bool //Read like a byte stream instead of messages
+	HandshakeTimeout  time.Duration
+	Linger            time.Duration //Close waits n for sent data to be acknowledged,0 aborts
+	Key               []byte        //pre-shared key,data packets are encrypted and authenticated when set
+	PrivateKey        []byte        //x25519 static key,runs the noise handshake instead of Key when set
+}
 
-func SetDebug(d bool)                { debug = d }
-func SetAtuoSend(send bool)          { autoSend = send }
-func SetSendTick(tick time.Duration) { sendTick = tick }
-func SetMaxSendNumPerTick(n int)     { maxSendNumPerTick = n }
+func DefaultConfig() Config {
+	return Config{
+		CorruptTick:    5,
+		ExpiredTick:    1e2 * 60 * 5, //5 minute on sendTick 1e7
+		SendDelayTick:  1,
+		MissingTime:    1e7,
+		ResendTime:     1e8,
+		MaxMessageSize: 1 << 20,
+		Window:         1 << 10,
+		MaxResendSize:  1 << 18,
+		MaxPacketSize:  1400,
+		Version:        PROTOCOL_VERSION,
+		Features:       FEATURES,
+		Congestion:     NewReno,
+
+		Debug:             false,
+		AutoSend:          true,
+		SendTick:          1e7,
+		MaxSendNumPerTick: 500,
+		StreamMode:        false,
+		HandshakeTimeout:  5 * time.Second,
+		Linger:            5 * time.Second,
+	}
+}
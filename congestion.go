@@ -0,0 +1,152 @@
+package rudp
+
+// Congestion limits the bytes a Rudp has in flight. It is called with the
+// Rudp locked,sizes are in byte,rtt and nano in nanosecond.
+type Congestion interface {
+	// Allow returns how many bytes can be sent now.
+	Allow(inflight int, nano int64) int
+	OnSend(bytes int, nano int64)
+	// OnAck is called when bytes are acknowledged,rtt is 0 before it is measured.
+	OnAck(bytes int, rtt int64, nano int64)
+	// OnLoss is called when the remote requests missing messages,or when
+	// messages are resent after a timeout.
+	OnLoss(timeout bool, rtt int64, nano int64)
+}
+
+const (
+	CONGESTION_MSS = GENERAL_PACKAGE
+	BBR_BURST_TIME = 2e7 //pacing saves at most n nanosecond of sending
+)
+
+type reno struct {
+	cwnd     int
+	ssthresh int
+	lastLoss int64
+}
+
+// NewReno returns a NewReno style AIMD controller,the window grows by the
+// acknowledged bytes in slow start,by one package per window after,and
+// halves once per rtt on loss.
+func NewReno() Congestion { return &reno{cwnd: 10 * CONGESTION_MSS, ssthresh: 1 << 30} }
+
+func (c *reno) Allow(inflight int, nano int64) int { return c.cwnd - inflight }
+func (c *reno) OnSend(bytes int, nano int64)       {}
+func (c *reno) OnAck(bytes int, rtt int64, nano int64) {
+	if c.cwnd < c.ssthresh {
+		c.cwnd += bytes
+	} else {
+		c.cwnd += CONGESTION_MSS * bytes / c.cwnd
+	}
+}
+func (c *reno) OnLoss(timeout bool, rtt int64, nano int64) {
+	if !timeout && nano < c.lastLoss+rtt {
+		return
+	}
+	c.lastLoss = nano
+	c.ssthresh = c.cwnd / 2
+	if c.ssthresh < 2*CONGESTION_MSS {
+		c.ssthresh = 2 * CONGESTION_MSS
+	}
+	if timeout {
+		c.cwnd = CONGESTION_MSS
+	} else {
+		c.cwnd = c.ssthresh
+	}
+}
+
+// pacing gain of each round in probe bandwidth,in quarter
+var bbrGain = []int64{5, 3, 4, 4, 4, 4, 4, 4}
+
+const BBR_STARTUP_GAIN = 11
+
+type bbr struct {
+	btlBw   int64 //max delivery rate in byte per second
+	bwTime  int64
+	minRTT  int64
+	rttTime int64
+
+	delivered      int64
+	roundTime      int64
+	roundDelivered int64
+
+	startup bool
+	full    int //rounds bandwidth not grow in startup
+	cycle   int
+
+	tokens int64
+	last   int64
+}
+
+// NewBBR returns a BBR like controller,it measures the bottleneck bandwidth
+// and min rtt every round,keeps two bandwidth delay products in flight and
+// paces sending at the bandwidth times a gain cycle. Loss is ignored.
+func NewBBR() Congestion { return &bbr{startup: true} }
+
+func (c *bbr) window() int {
+	if c.btlBw == 0 || c.minRTT == 0 {
+		return 10 * CONGESTION_MSS
+	}
+	w := int(2 * c.btlBw * (c.minRTT / 1e3) / 1e6)
+	if w < 4*CONGESTION_MSS {
+		w = 4 * CONGESTION_MSS
+	}
+	return w
+}
+
+func (c *bbr) rate() int64 {
+	if c.startup {
+		return c.btlBw * BBR_STARTUP_GAIN / 4
+	}
+	return c.btlBw * bbrGain[c.cycle] / 4
+}
+
+func (c *bbr) Allow(inflight int, nano int64) int {
+	allow := c.window() - inflight
+	if c.btlBw == 0 {
+		return allow
+	}
+	elapsed := nano - c.last
+	if elapsed > BBR_BURST_TIME {
+		elapsed = BBR_BURST_TIME
+	}
+	c.last = nano
+	c.tokens += c.rate() * (elapsed / 1e3) / 1e6
+	if burst := c.rate() * (BBR_BURST_TIME / 1e3) / 1e6; c.tokens > burst {
+		c.tokens = burst
+	}
+	if c.tokens < int64(allow) {
+		allow = int(c.tokens)
+	}
+	return allow
+}
+
+func (c *bbr) OnSend(bytes int, nano int64) { c.tokens -= int64(bytes) }
+
+func (c *bbr) OnAck(bytes int, rtt int64, nano int64) {
+	c.delivered += int64(bytes)
+	if rtt > 0 && (c.minRTT == 0 || rtt < c.minRTT || nano > c.rttTime+10e9) {
+		c.minRTT, c.rttTime = rtt, nano
+	}
+	if c.roundTime == 0 {
+		c.roundTime, c.roundDelivered = nano, c.delivered-int64(bytes)
+	}
+	if c.minRTT == 0 || nano-c.roundTime < c.minRTT {
+		return
+	}
+	bw := (c.delivered - c.roundDelivered) * 1e6 / ((nano - c.roundTime) / 1e3)
+	c.roundTime, c.roundDelivered = nano, c.delivered
+	if c.startup {
+		if bw*4 >= c.btlBw*5 {
+			c.full = 0
+		} else if c.full++; c.full >= 3 {
+			c.startup = false
+		}
+	} else {
+		c.cycle = (c.cycle + 1) % len(bbrGain)
+	}
+	if bw >= c.btlBw || nano > c.bwTime+10*c.minRTT {
+		c.btlBw, c.bwTime = bw, nano
+	}
+}
+
+func (c *bbr) OnLoss(timeout bool, rtt int64, nano int64) {}
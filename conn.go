@@ -1,25 +1,50 @@
 package rudp
 
 import (
+	"crypto/hmac"
+	"io"
 	"net"
+	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// NewConn runs rudp on a connected conn,the settings come from the Config
+// rudp was created with. It starts the handshake with a RudpListener,data
+// written before it finishes is sent after. conn is closed when the
+// connection ends.
 func NewConn(conn *net.UDPConn, rudp *Rudp) *RudpConn {
 	con := &RudpConn{conn: conn, rudp: rudp,
-		recvChan: make(chan []byte, 1<<16), recvErr: make(chan error, 2),
-		sendChan: make(chan []byte, 1<<16), sendErr: make(chan error, 2),
+		recvChan: make(chan []byte, rudp.conf.Window), recvErr: make(chan error, 2),
+		sendChan: make(chan *message, rudp.conf.Window), sendErr: make(chan error, 2),
 		SendTick: make(chan int, 2),
+		rd:       newDeadline(), wd: newDeadline(),
+		nonce: newSession(), established: make(chan struct{}), start: time.Now(),
+		closing: make(chan struct{}), flushed: make(chan struct{}), stopped: make(chan struct{}),
+		rclosed: make(chan struct{}), done: make(chan struct{}),
+	}
+	if key := rudp.conf.PrivateKey; key != nil {
+		con.noise, con.hello, con.noiseErr = initiateNoise(key, con.nonce)
 	}
 	go con.run()
 	return con
 }
 
 func NewUnConn(conn *net.UDPConn, remoteAddr *net.UDPAddr, rudp *Rudp, close func(string)) *RudpConn {
+	return newUnConn(conn, remoteAddr, rudp, close, newSession(), 0)
+}
+
+func newUnConn(conn *net.UDPConn, remoteAddr *net.UDPAddr, rudp *Rudp, close func(string),
+	session, nonce uint32) *RudpConn {
 	con := &RudpConn{conn: conn, rudp: rudp, SendTick: make(chan int, 2),
-		recvChan: make(chan []byte, 1<<16), recvErr: make(chan error, 2),
-		sendChan: make(chan []byte, 1<<16), sendErr: make(chan error, 2),
+		recvChan: make(chan []byte, rudp.conf.Window), recvErr: make(chan error, 2),
+		sendChan: make(chan *message, rudp.conf.Window), sendErr: make(chan error, 2),
 		closef: close, remoteAddr: remoteAddr, in: make(chan []byte, 1<<16),
+		rd: newDeadline(), wd: newDeadline(),
+		session: session, nonce: nonce, established: make(chan struct{}), start: time.Now(),
+		closing: make(chan struct{}), flushed: make(chan struct{}), stopped: make(chan struct{}),
+		rclosed: make(chan struct{}), done: make(chan struct{}),
 	}
 	go con.run()
 	return con
@@ -30,148 +55,605 @@ type RudpConn struct {
 
 	rudp *Rudp
 
-	recvChan chan []byte
-	recvErr  chan error
+	recvChan   chan []byte
+	recvErr    chan error
+	rlock      sync.Mutex
+	rbuf       []byte
+	rerr       error //returned by every Read after
+	recvEOF    bool
+	rclosed    chan struct{} //CloseRead is called
+	rcloseOnce sync.Once
 
-	sendChan chan []byte
-	sendErr  chan error
+	sendChan  chan *message
+	sendErr   chan error
+	wlock     sync.Mutex
+	wclosed   bool     //FIN is queued
+	pending   *message //blocked by the remote window
+	finSent   bool
+	remoteFin bool
 
 	SendTick chan int
 
+	rd *deadline
+	wd *deadline
+
+	//close
+	closeOnce sync.Once
+	closeAt   time.Time
+	closing   chan struct{} //Close is called
+	flushed   chan struct{} //data sent before Close is acknowledged
+	stopped   chan struct{} //sendLoop returned
+	doneOnce  sync.Once
+	done      chan struct{} //every goroutine returns
+
+	//handshake
+	session     uint32
+	nonce       uint32
+	cookie      atomic.Value //from RETRY
+	crypt       atomic.Value //*crypt after the handshake,with Config.Key
+	peerKey     atomic.Value //static public key of the remote,by noise
+	established chan struct{}
+	start       time.Time
+	synSent     time.Time
+
+	//noise,the messages are sent again until answered
+	noise     *noise
+	noiseErr  error
+	hello     []byte //in SYN or SYN_ACK
+	finish    []byte //sent with data
+	confirmed int32  //data of the server is received
+
 	//unconected
 	remoteAddr *net.UDPAddr
+	addrLock   sync.Mutex
 	closef     func(addr string)
 	in         chan []byte
+	accepted   bool //by listener
+
+	//path validation by listener
+	challenge     []byte
+	challengeAddr *net.UDPAddr
+	challengeSent time.Time
+	challengeRecv int //bytes received from challengeAddr
+	challengeSize int //bytes sent to challengeAddr
 }
 
-func (rc *RudpConn) SetDeadline(t time.Time) error      { return nil }
-func (rc *RudpConn) SetReadDeadline(t time.Time) error  { return nil }
-func (rc *RudpConn) SetWriteDeadline(t time.Time) error { return nil }
+func (rc *RudpConn) SetDeadline(t time.Time) error {
+	rc.rd.set(t)
+	rc.wd.set(t)
+	return nil
+}
+func (rc *RudpConn) SetReadDeadline(t time.Time) error  { rc.rd.set(t); return nil }
+func (rc *RudpConn) SetWriteDeadline(t time.Time) error { rc.wd.set(t); return nil }
 func (rc *RudpConn) LocalAddr() net.Addr                { return rc.conn.LocalAddr() }
-func (rc *RudpConn) Connected() bool                    { return rc.remoteAddr == nil }
+func (rc *RudpConn) RTT() time.Duration                 { return rc.rudp.RTT() }
+func (rc *RudpConn) PMTU() int                          { return rc.rudp.PMTU() }
+func (rc *RudpConn) Version() (version, features int)   { return rc.rudp.Version() }
+func (rc *RudpConn) BadPackages() int                   { return rc.rudp.BadPackages() }
+func (rc *RudpConn) Connected() bool                    { return rc.in == nil }
 func (rc *RudpConn) RemoteAddr() net.Addr {
-	if rc.remoteAddr != nil {
-		return rc.remoteAddr
+	if !rc.Connected() {
+		return rc.peer()
 	}
 	return rc.conn.RemoteAddr()
 }
+
+// PeerPublicKey returns the static public key the remote proved to hold in
+// the noise handshake,nil without Config.PrivateKey.
+func (rc *RudpConn) PeerPublicKey() []byte {
+	key, _ := rc.peerKey.Load().([]byte)
+	return key
+}
+
+func (rc *RudpConn) peer() *net.UDPAddr {
+	rc.addrLock.Lock()
+	defer rc.addrLock.Unlock()
+	return rc.remoteAddr
+}
+
+// migrate sends to addr from now on,the listener calls it after addr
+// answers a path challenge.
+func (rc *RudpConn) migrate(addr *net.UDPAddr) {
+	rc.rudp.dbg("migrate from %v to %v,local %v", rc.peer(), addr, rc.LocalAddr())
+	rc.addrLock.Lock()
+	rc.remoteAddr = addr
+	rc.addrLock.Unlock()
+}
+
+// Close sends the data written before and a FIN,and waits up to Linger
+// for the remote to acknowledge them,the remote Read returns io.EOF after
+// the data. If Linger passes the connection is aborted and ErrTimeout
+// returned,if it ends before,the error it ends with. A zero Linger aborts
+// at once.
 func (rc *RudpConn) Close() error {
-	var err error
-	if rc.remoteAddr != nil {
-		if rc.closef != nil {
-			rc.closef(rc.remoteAddr.String())
+	first := false
+	rc.closeOnce.Do(func() {
+		rc.closeAt, first = time.Now(), true
+		close(rc.closing)
+	})
+	if !first {
+		return ErrClosed
+	}
+	if rc.rudp.conf.Linger <= 0 {
+		rc.abort()
+		return nil
+	}
+	expired := make(chan struct{})
+	linger := time.AfterFunc(rc.rudp.conf.Linger, func() { close(expired) })
+	defer linger.Stop()
+	err := rc.shutdown(expired)
+	if err == nil {
+		select {
+		case <-rc.flushed:
+		case <-rc.stopped:
+		case <-expired:
 		}
-		_, err = rc.conn.WriteToUDP([]byte{TYPE_CORRUPT}, rc.remoteAddr)
-		rc.in <- []byte{TYPE_EOF}
-	} else {
-		_, err = rc.conn.Write([]byte{TYPE_CORRUPT})
 	}
+	if isClosed(rc.flushed) {
+		return nil
+	}
+	if rc.rudp.corrupt.Load() != ERROR_NIL {
+		if err == nil {
+			select {
+			case err = <-rc.sendErr:
+			default:
+				err = rc.rudp.corrupt.Err()
+			}
+		}
+		rc.teardown()
+		return err
+	}
+	rc.rudp.dbg("close linger timeout,local %v,remote %v", rc.LocalAddr(), rc.RemoteAddr())
+	rc.abort()
+	return ErrTimeout
+}
+
+// CloseWrite sends a FIN after the data written before,the remote Read
+// returns io.EOF after the data,and it can still write to this side.
+func (rc *RudpConn) CloseWrite() error {
+	if isClosed(rc.closing) {
+		return ErrClosed
+	}
+	return rc.shutdown(rc.wd.wait())
+}
+
+// CloseRead makes Read return io.EOF,data received after is dropped.
+func (rc *RudpConn) CloseRead() error {
+	if isClosed(rc.closing) {
+		return ErrClosed
+	}
+	rc.rcloseOnce.Do(func() { close(rc.rclosed) })
+	return nil
+}
+
+// shutdown queues the FIN once.
+func (rc *RudpConn) shutdown(timeout chan struct{}) error {
+	rc.wlock.Lock()
+	defer rc.wlock.Unlock()
+	if rc.wclosed {
+		return nil
+	}
+	if isClosed(rc.done) {
+		return rc.rudp.corrupt.Err()
+	}
+	select {
+	case rc.sendChan <- &message{eof: true}:
+		rc.wclosed = true
+		return nil
+	case err := <-rc.sendErr:
+		return err
+	case <-rc.done:
+		return rc.rudp.corrupt.Err()
+	case <-rc.stopped:
+		return ErrClosed
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// abort tells the remote to drop the connection at once.
+func (rc *RudpConn) abort() {
+	_, err := rc.write(PACKET_DATA, rc.rudp.abortPackage())
 	checkErr(err)
-	return err
+	rc.teardown()
 }
+
+// teardown stops rudp and the goroutines,closes the conn of NewConn,and
+// removes the connection from the listener.
+func (rc *RudpConn) teardown() {
+	rc.doneOnce.Do(func() {
+		if rc.rudp.corrupt.Load() == ERROR_NIL {
+			rc.rudp.corrupt.Store(ERROR_EOF)
+		}
+		close(rc.done)
+		if rc.Connected() {
+			rc.conn.Close()
+		} else if rc.closef != nil {
+			rc.closef(rc.peer().String())
+		}
+	})
+}
+
+// Read returns one message in message mode,io.ErrShortBuffer if bts is too
+// small for it. In stream mode the rest of a message is kept for the next Read.
 func (rc *RudpConn) Read(bts []byte) (n int, err error) {
+	rc.rlock.Lock()
+	defer rc.rlock.Unlock()
+	if isClosed(rc.closing) {
+		return 0, ErrClosed
+	}
+	if isClosed(rc.rclosed) {
+		return 0, io.EOF
+	}
+	if isClosed(rc.rd.wait()) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	if len(rc.rbuf) > 0 {
+		return rc.readStream(bts, nil), nil
+	}
+	data, err := rc.next()
+	if err != nil {
+		return 0, err
+	}
+	if rc.rudp.conf.StreamMode {
+		return rc.readStream(bts, data), nil
+	}
+	n = copy(bts, data)
+	if n < len(data) {
+		return n, io.ErrShortBuffer
+	}
+	return n, nil
+}
+
+// next returns a received message,the error after all messages before it.
+func (rc *RudpConn) next() ([]byte, error) {
 	select {
 	case data := <-rc.recvChan:
-		copy(bts, data)
-		return len(data), nil
-	case err := <-rc.recvErr:
-		return 0, err
+		return data, nil
+	default:
+	}
+	if rc.rerr != nil {
+		return nil, rc.rerr
+	}
+	select {
+	case data := <-rc.recvChan:
+		return data, nil
+	case rc.rerr = <-rc.recvErr:
+		//messages are put in recvChan before the error
+		select {
+		case data := <-rc.recvChan:
+			return data, nil
+		default:
+			return nil, rc.rerr
+		}
+	case <-rc.closing:
+		return nil, ErrClosed
+	case <-rc.rclosed:
+		return nil, io.EOF
+	case <-rc.done:
+		select {
+		case data := <-rc.recvChan:
+			return data, nil
+		default:
+			return nil, rc.rudp.corrupt.Err()
+		}
+	case <-rc.rd.wait():
+		return nil, os.ErrDeadlineExceeded
+	}
+}
+
+func (rc *RudpConn) readStream(bts []byte, data []byte) (n int) {
+	if len(rc.rbuf) == 0 {
+		rc.rbuf = data
+	}
+	for {
+		c := copy(bts[n:], rc.rbuf)
+		rc.rbuf, n = rc.rbuf[c:], n+c
+		if len(rc.rbuf) > 0 || n == len(bts) {
+			return
+		}
+		select {
+		case rc.rbuf = <-rc.recvChan:
+		default:
+			return
+		}
 	}
 }
 
 func (rc *RudpConn) send(bts []byte) (err error) {
+	if isClosed(rc.closing) || rc.wclosed {
+		return ErrClosed
+	}
+	if isClosed(rc.done) {
+		return rc.rudp.corrupt.Err()
+	}
+	if isClosed(rc.wd.wait()) {
+		return os.ErrDeadlineExceeded
+	}
+	m := &message{}
+	m.buf.Write(bts)
 	select {
-	case rc.sendChan <- bts:
+	case rc.sendChan <- m:
 		return nil
 	case err := <-rc.sendErr:
 		return err
+	case <-rc.done:
+		return rc.rudp.corrupt.Err()
+	case <-rc.closing:
+		return ErrClosed
+	case <-rc.wd.wait():
+		return os.ErrDeadlineExceeded
 	}
 }
+
+// Write keeps message boundary,a message longer than MAX_FRAGMENT is sent
+// as fragments and joined together by the remote Read,it returns
+// ErrMessageTooLarge for one longer than MaxMessageSize. In stream mode
+// bts is sent as plain messages of at most MAX_FRAGMENT.
 func (rc *RudpConn) Write(bts []byte) (n int, err error) {
-	sz := len(bts)
-	for len(bts)+MAX_MSG_HEAD > GENERAL_PACKAGE {
-		if err := rc.send(bts[:GENERAL_PACKAGE-MAX_MSG_HEAD]); err != nil {
+	rc.wlock.Lock()
+	defer rc.wlock.Unlock()
+	if !rc.rudp.conf.StreamMode {
+		if len(bts) > rc.rudp.conf.MaxMessageSize {
+			return 0, ErrMessageTooLarge
+		}
+		if err := rc.send(bts); err != nil {
 			return 0, err
 		}
-		bts = bts[GENERAL_PACKAGE-MAX_MSG_HEAD:]
+		return len(bts), nil
 	}
-	return sz, rc.send(bts)
+	for n < len(bts) {
+		sz := len(bts) - n
+		if sz > MAX_FRAGMENT {
+			sz = MAX_FRAGMENT
+		}
+		if err := rc.send(bts[n : n+sz]); err != nil {
+			return n, err
+		}
+		n += sz
+	}
+	return n, nil
 }
 
-func (rc *RudpConn) rudpRecv(data []byte) error {
-	for {
-		n, err := rc.rudp.Recv(data)
-		if err != nil {
+// rudpRecv moves received messages to recvChan while there is room,the rest
+// stay in rudp and shrink the window it advertises. After the FIN rudp still
+// takes input for the other direction.
+func (rc *RudpConn) rudpRecv() error {
+	for isClosed(rc.rclosed) || len(rc.recvChan) < cap(rc.recvChan) {
+		bts, err := rc.rudp.recv()
+		if err == io.EOF {
+			if !rc.recvEOF {
+				rc.recvEOF = true
+				rc.recvErr <- err
+			}
+			return nil
+		} else if err != nil {
 			rc.recvErr <- err
 			return err
-		} else if n == 0 {
+		} else if bts == nil {
 			break
+		} else if isClosed(rc.rclosed) {
+			continue
 		}
-		bts := make([]byte, n)
-		copy(bts, data[:n])
 		rc.recvChan <- bts
 	}
 	return nil
 }
+func (rc *RudpConn) write(kind byte, bts []byte) (int, error) {
+	var p []byte
+	if c, _ := rc.crypt.Load().(*crypt); c != nil && kind == PACKET_DATA {
+		p = c.seal(kind, atomic.LoadUint32(&rc.session), bts)
+	} else {
+		p = packPacket(kind, atomic.LoadUint32(&rc.session), bts)
+	}
+	if rc.Connected() {
+		return rc.conn.Write(p)
+	}
+	return rc.conn.WriteToUDP(p, rc.peer())
+}
+
+// open returns the package of a data packet,false if Config.Key or
+// Config.PrivateKey is set and the packet is not sealed by the remote.
+func (rc *RudpConn) open(packet []byte) ([]byte, bool) {
+	if rc.rudp.conf.Key == nil && rc.rudp.conf.PrivateKey == nil {
+		return packet[PACKET_HEAD:], true
+	}
+	c, _ := rc.crypt.Load().(*crypt)
+	if c == nil {
+		return nil, false
+	}
+	return c.open(packet)
+}
+
+// handshake sends SYN again until SYN_ACK comes on the client side,and
+// gives up after HandshakeTimeout on both sides.
+func (rc *RudpConn) handshake() error {
+	if rc.noiseErr != nil {
+		rc.rudp.corrupt.Store(ERROR_EOF)
+		rc.recvErr <- rc.noiseErr
+		return rc.noiseErr
+	}
+	now := time.Now()
+	if now.Sub(rc.start) > rc.rudp.conf.HandshakeTimeout {
+		rc.rudp.dbg("handshake timeout,local %v,remote %v", rc.LocalAddr(), rc.RemoteAddr())
+		rc.rudp.corrupt.Store(ERROR_CORRUPT)
+		if rc.closef != nil {
+			rc.closef(rc.peer().String())
+		}
+		err := rc.rudp.corrupt.Err()
+		rc.recvErr <- err
+		return err
+	}
+	if rc.Connected() && now.Sub(rc.synSent) >= time.Duration(rc.rudp.conf.ResendTime) {
+		rc.synSent = now
+		cookie, _ := rc.cookie.Load().([]byte)
+		_, err := rc.write(PACKET_SYN, append(packSyn(rc.nonce, cookie), rc.offer()...))
+		return err
+	}
+	return nil
+}
+
+// offer returns the version and features the client supports,and the
+// first noise message.
+func (rc *RudpConn) offer() []byte {
+	return packHello(rc.rudp.conf.Version, rc.rudp.conf.Features, rc.hello)
+}
+
+// synAck finishes the handshake on the client side,false if body does not
+// answer the SYN.
+func (rc *RudpConn) synAck(session uint32, body []byte) bool {
+	nonce, ok := unpackNonce(body)
+	if !ok || nonce != rc.nonce || session == 0 {
+		return false
+	}
+	if key := rc.rudp.conf.Key; key != nil && rc.noise == nil {
+		n := len(body) - CRYPT_TAG
+		if n < PACKET_NONCE || !hmac.Equal(body[n:], synAckTag(key, session, body[:n])) {
+			rc.rudp.dbg("unauthentic syn ack of session %v,local %v", session, rc.LocalAddr())
+			return false
+		}
+		body = body[:n]
+	}
+	version, features, msg := unpackHello(body, PACKET_NONCE)
+	if hs := rc.noise; hs != nil {
+		saved := *hs //a forged SYN_ACK does not break it
+		err := hs.readMessage2(msg)
+		if err == nil {
+			rc.finish, err = hs.writeMessage3()
+		}
+		if err != nil {
+			*hs = saved
+			rc.rudp.dbg("noise syn ack %v,local %v", err, rc.LocalAddr())
+			return false
+		}
+		rc.peerKey.Store(hs.peer())
+		rc.crypt.Store(hs.split())
+		rc.noise = nil
+	} else if key := rc.rudp.conf.Key; key != nil {
+		rc.crypt.Store(newCrypt(key, session, rc.nonce, false))
+	}
+	rc.rudp.Negotiate(version, features)
+	atomic.StoreUint32(&rc.session, session)
+	close(rc.established)
+	return true
+}
+
 func (rc *RudpConn) conectedRecvLoop() {
 	data := make([]byte, MAX_PACKAGE)
 	for {
 		n, err := rc.conn.Read(data)
-		if err != nil {
+		if isClosed(rc.done) {
+			return
+		} else if err != nil {
 			rc.recvErr <- err
 			return
 		}
-		rc.rudp.Input(data[:n])
-		if rc.rudpRecv(data) != nil {
+		kind, session, body, ok := unpackPacket(data[:n])
+		if !ok {
+			continue
+		}
+		if kind == PACKET_RETRY && !isClosed(rc.established) {
+			if nonce, cookie, ok := unpackSyn(body); ok && nonce == rc.nonce {
+				cookie = append([]byte(nil), cookie...)
+				rc.cookie.Store(cookie)
+				_, err := rc.write(PACKET_SYN, append(packSyn(rc.nonce, cookie), rc.offer()...))
+				checkErr(err)
+			}
+			continue
+		}
+		if kind == PACKET_CHALLENGE && session == atomic.LoadUint32(&rc.session) {
+			if len(body) >= PACKET_PATH {
+				_, err := rc.write(PACKET_RESPONSE, body[:PACKET_PATH])
+				checkErr(err)
+			}
+			continue
+		}
+		if kind == PACKET_SYN_ACK && !isClosed(rc.established) {
+			rc.synAck(session, body)
+			continue
+		}
+		if kind != PACKET_DATA || session != atomic.LoadUint32(&rc.session) || !isClosed(rc.established) {
+			rc.rudp.dbg("drop packet %v of session %v,local %v", kind, session, rc.LocalAddr())
+			continue
+		}
+		if body, ok = rc.open(data[:n]); !ok {
+			rc.rudp.dbg("drop unauthentic or replayed packet of session %v,local %v", session, rc.LocalAddr())
+			continue
+		}
+		atomic.StoreInt32(&rc.confirmed, 1)
+		rc.rudp.Input(body)
+		if rc.rudpRecv() != nil {
 			return
 		}
 	}
 }
 func (rc *RudpConn) unconectedRecvLoop() {
-	data := make([]byte, MAX_PACKAGE)
 	for {
 		select {
 		case bts := <-rc.in:
+			if !isClosed(rc.established) {
+				close(rc.established)
+			}
 			rc.rudp.Input(bts)
-			if rc.rudpRecv(data) != nil {
+			if rc.rudpRecv() != nil {
 				return
 			}
+		case <-rc.done:
+			return
 		}
 	}
 }
+
+// sendLoop returns when the connection ends for any reason,and tears it down.
 func (rc *RudpConn) sendLoop() {
+	defer rc.teardown()
+	defer close(rc.stopped)
 	var sendNum int
 	for {
 		select {
+		case <-rc.done:
+			return
 		case tick := <-rc.SendTick:
+			if !isClosed(rc.established) {
+				if err := rc.handshake(); err != nil {
+					rc.sendErr <- err
+					return
+				}
+				continue
+			}
 		sendOut:
-			for {
-				select {
-				case bts := <-rc.sendChan:
-					_, err := rc.rudp.Send(bts)
-					if err != nil {
-						rc.sendErr <- err
-						return
-					}
-					sendNum++
-					if sendNum >= maxSendNumPerTick {
+			for sendNum < rc.rudp.conf.MaxSendNumPerTick {
+				m := rc.pending
+				if m == nil {
+					select {
+					case m = <-rc.sendChan:
+					default:
 						break sendOut
 					}
-				default:
+				}
+				rc.pending = nil
+				err := rc.rudp.send(m)
+				if err == ErrWouldBlock {
+					rc.pending = m
 					break sendOut
+				} else if err != nil {
+					rc.sendErr <- err
+					return
 				}
+				rc.finSent = rc.finSent || m.eof
+				sendNum++
 			}
 			sendNum = 0
+			if rc.finish != nil && atomic.LoadInt32(&rc.confirmed) == 0 {
+				_, err := rc.write(PACKET_FINISH, rc.finish)
+				checkErr(err)
+			}
 			p := rc.rudp.Update(tick)
 			var num, sz int
 			for p != nil {
-				n, err := int(0), error(nil)
-				if rc.Connected() {
-					n, err = rc.conn.Write(p.Bts)
-				} else {
-					n, err = rc.conn.WriteToUDP(p.Bts, rc.remoteAddr)
-				}
+				n, err := rc.write(PACKET_DATA, p.Bts)
 				if err != nil {
+					rc.rudp.corrupt.Store(ERROR_EOF)
 					rc.sendErr <- err
 					return
 				}
@@ -179,21 +661,50 @@ func (rc *RudpConn) sendLoop() {
 				p = p.Next
 			}
 			if num > 1 {
-				show := bitShow(sz * int(time.Second/sendTick))
-				dbg("send package num %v,sz %v, %v/s,local %v,remote %v",
+				show := bitShow(sz * int(time.Second/rc.rudp.conf.SendTick))
+				rc.rudp.dbg("send package num %v,sz %v, %v/s,local %v,remote %v",
 					num, show, show, rc.LocalAddr(), rc.RemoteAddr())
 			}
+			if rc.rudp.corrupt.Load() != ERROR_NIL || isClosed(rc.closing) && rc.linger() {
+				return
+			}
 		}
 	}
 }
+
+// linger tells Close when the data sent is acknowledged,and stops rudp a
+// tick after the FIN of the remote is received,so it is acknowledged,or
+// after Linger passed. It returns true when rudp is stopped.
+func (rc *RudpConn) linger() bool {
+	if rc.rudp.corrupt.Load() != ERROR_NIL {
+		return true
+	}
+	if !isClosed(rc.flushed) && rc.finSent && rc.rudp.Flushed() {
+		close(rc.flushed)
+	}
+	if isClosed(rc.flushed) && (rc.remoteFin || time.Since(rc.closeAt) > rc.rudp.conf.Linger) {
+		rc.teardown()
+		return true
+	}
+	rc.remoteFin = rc.rudp.eof()
+	return false
+}
+
 func (rc *RudpConn) run() {
-	if autoSend && sendTick > 0 {
+	if rc.rudp.conf.AutoSend && rc.rudp.conf.SendTick > 0 {
 		go func() {
-			tick := time.Tick(sendTick)
+			ticker := time.NewTicker(rc.rudp.conf.SendTick)
+			defer ticker.Stop()
 			for {
 				select {
-				case <-tick:
-					rc.SendTick <- 1
+				case <-ticker.C:
+					select {
+					case rc.SendTick <- 1:
+					case <-rc.done:
+						return
+					}
+				case <-rc.done:
+					return
 				}
 			}
 		}()
@@ -0,0 +1,74 @@
+package rudp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+const (
+	COOKIE_ROTATE  = 30 * time.Second //the secret changes every n,the previous one is still accepted
+	COOKIE_TIMEOUT = 30               //a cookie is valid n second
+	COOKIE_MAC     = 16
+)
+
+// cookieSecret makes the cookies a RudpListener sends back to a SYN without
+// a valid one,a client proves it receives at its address by echoing it.
+// It is only used by the listener run loop.
+type cookieSecret struct {
+	cur     []byte
+	prev    []byte
+	rotated time.Time
+}
+
+func newSecret() []byte {
+	b := make([]byte, sha256.Size)
+	rand.Read(b)
+	return b
+}
+
+func (s *cookieSecret) rotate(now time.Time) {
+	if s.cur == nil {
+		s.cur, s.prev, s.rotated = newSecret(), newSecret(), now
+	} else if now.Sub(s.rotated) >= COOKIE_ROTATE {
+		s.cur, s.prev, s.rotated = newSecret(), s.cur, now
+	}
+}
+
+func cookieMac(secret []byte, addr *net.UDPAddr, nonce uint32, ts uint32) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write(addr.IP.To16())
+	var b [10]byte
+	binary.BigEndian.PutUint16(b[0:], uint16(addr.Port))
+	binary.BigEndian.PutUint32(b[2:], nonce)
+	binary.BigEndian.PutUint32(b[6:], ts)
+	h.Write(b[:])
+	return h.Sum(nil)[:COOKIE_MAC]
+}
+
+// make returns [unix second 4][mac 16]
+func (s *cookieSecret) make(addr *net.UDPAddr, nonce uint32, now time.Time) []byte {
+	s.rotate(now)
+	ts := uint32(now.Unix())
+	cookie := make([]byte, PACKET_COOKIE)
+	binary.BigEndian.PutUint32(cookie, ts)
+	copy(cookie[4:], cookieMac(s.cur, addr, nonce, ts))
+	return cookie
+}
+
+func (s *cookieSecret) check(addr *net.UDPAddr, nonce uint32, cookie []byte, now time.Time) bool {
+	s.rotate(now)
+	if len(cookie) != PACKET_COOKIE {
+		return false
+	}
+	ts := binary.BigEndian.Uint32(cookie)
+	if age := uint32(now.Unix()) - ts; age > COOKIE_TIMEOUT {
+		return false
+	}
+	mac := cookie[4:]
+	return hmac.Equal(mac, cookieMac(s.cur, addr, nonce, ts)) ||
+		hmac.Equal(mac, cookieMac(s.prev, addr, nonce, ts))
+}
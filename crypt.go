@@ -0,0 +1,138 @@
+package rudp
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"sync/atomic"
+)
+
+// with Config.Key the body of every data packet is sealed by AES-GCM,the
+// body is a packet number and the sealed package.
+//
+//	DATA(session,number 8,sealed package,tag 16)
+//
+// Each direction has its own key,derived from Config.Key,the session and
+// the nonce of the handshake. The number counts the packets sent in a
+// direction and makes the gcm nonce,the packet head and it are
+// authenticated with the package. A number received before,or more than
+// REPLAY_WINDOW behind the largest one,is dropped,so a captured packet can
+// not be replayed.
+//
+//	SYN_ACK(session,nonce,version,tag 16)
+//
+// The SYN_ACK ends with a HMAC of the session and the rest of it under
+// Config.Key,a forged one can not give the client a dead session.
+const (
+	CRYPT_NUMBER  = 8
+	CRYPT_TAG     = 16
+	REPLAY_WINDOW = 1 << 12
+)
+
+const (
+	CRYPT_CLIENT  = "rudp client"
+	CRYPT_SERVER  = "rudp server"
+	CRYPT_SYN_ACK = "rudp syn ack"
+)
+
+type crypt struct {
+	send   cipher.AEAD
+	recv   cipher.AEAD
+	number uint64 //last sent,atomic
+	replay replayWindow
+}
+
+// newCrypt returns the crypt of the client side,or of the server side if
+// server is true.
+func newCrypt(key []byte, session, nonce uint32, server bool) *crypt {
+	c := &crypt{send: deriveKey(key, CRYPT_CLIENT, session, nonce),
+		recv: deriveKey(key, CRYPT_SERVER, session, nonce)}
+	if server {
+		c.send, c.recv = c.recv, c.send
+	}
+	return c
+}
+
+func deriveKey(key []byte, label string, session, nonce uint32) cipher.AEAD {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	var b [8]byte
+	binary.BigEndian.PutUint32(b[:], session)
+	binary.BigEndian.PutUint32(b[4:], nonce)
+	mac.Write(b[:])
+	return newGCM(mac.Sum(nil))
+}
+
+// synAckTag returns the tag of a SYN_ACK of session with body.
+func synAckTag(key []byte, session uint32, body []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(CRYPT_SYN_ACK))
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], session)
+	mac.Write(b[:])
+	mac.Write(body)
+	return mac.Sum(nil)[:CRYPT_TAG]
+}
+
+func gcmNonce(number []byte) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce[12-CRYPT_NUMBER:], number)
+	return nonce
+}
+
+// seal returns the packet of kind and session with bts sealed.
+func (c *crypt) seal(kind byte, session uint32, bts []byte) []byte {
+	p := make([]byte, PACKET_HEAD+CRYPT_NUMBER, PACKET_HEAD+CRYPT_NUMBER+len(bts)+CRYPT_TAG)
+	p[0] = kind
+	binary.BigEndian.PutUint32(p[1:], session)
+	binary.BigEndian.PutUint64(p[PACKET_HEAD:], atomic.AddUint64(&c.number, 1))
+	head := append([]byte(nil), p...) //dst may not overlap it
+	return c.send.Seal(p, gcmNonce(head[PACKET_HEAD:]), bts, head)
+}
+
+// open returns the package sealed in packet,false if it is not authentic
+// or replayed. It is only called by the receiving goroutine.
+func (c *crypt) open(packet []byte) ([]byte, bool) {
+	if len(packet) < PACKET_HEAD+CRYPT_NUMBER+CRYPT_TAG {
+		return nil, false
+	}
+	head := packet[:PACKET_HEAD+CRYPT_NUMBER]
+	bts, err := c.recv.Open(nil, gcmNonce(head[PACKET_HEAD:]), packet[len(head):], head)
+	if err != nil {
+		return nil, false
+	}
+	return bts, c.replay.check(binary.BigEndian.Uint64(head[PACKET_HEAD:]))
+}
+
+// replayWindow marks the packet numbers received,up to REPLAY_WINDOW
+// behind the largest one.
+type replayWindow struct {
+	max  uint64
+	bits [REPLAY_WINDOW / 64]uint64
+}
+
+// check returns false if n is received before or too old,else marks it.
+func (w *replayWindow) check(n uint64) bool {
+	if n == 0 {
+		return false //numbers start from 1
+	}
+	if n > w.max {
+		if n-w.max >= REPLAY_WINDOW {
+			w.bits = [REPLAY_WINDOW / 64]uint64{}
+		} else {
+			for i := w.max + 1; i <= n; i++ {
+				w.bits[i/64%uint64(len(w.bits))] &^= 1 << (i % 64)
+			}
+		}
+		w.max = n
+	} else if w.max-n >= REPLAY_WINDOW {
+		return false
+	}
+	word, bit := &w.bits[n/64%uint64(len(w.bits))], uint64(1)<<(n%64)
+	if *word&bit != 0 {
+		return false
+	}
+	*word |= bit
+	return true
+}
@@ -1,49 +1,97 @@
 package rudp
 
 import (
+	"bytes"
+	"crypto/rand"
 	"net"
 	"sync"
+	"time"
 )
 
-func NewListener(conn *net.UDPConn) *RudpListener {
-	listen := &RudpListener{conn: conn,
+// NewListener accepts rudp connections on conn,each one runs a Rudp with the
+// given config,DefaultConfig if there is none.
+func NewListener(conn *net.UDPConn, conf ...Config) *RudpListener {
+	listen := &RudpListener{conn: conn, conf: DefaultConfig(),
 		newRudpConn: make(chan *RudpConn, 1024),
 		newRudpErr:  make(chan error, 12),
-		rudpConnMap: make(map[string]*RudpConn)}
+		rudpConnMap: make(map[uint32]*RudpConn),
+		synMap:      make(map[string]*RudpConn)}
+	if len(conf) > 0 {
+		listen.conf = conf[0]
+	}
 	go listen.run()
 	return listen
 }
 
 type RudpListener struct {
 	conn *net.UDPConn
+	conf Config
 	lock sync.RWMutex
 
 	newRudpConn chan *RudpConn
 	newRudpErr  chan error
-	rudpConnMap map[string]*RudpConn
+	rudpConnMap map[uint32]*RudpConn //by session
+	synMap      map[string]*RudpConn //by address before accepted
+	cookie      cookieSecret
+	closed      bool //no new connection after Close
 }
 
 //net listener interface
 func (this *RudpListener) Accept() (net.Conn, error) { return this.AcceptRudp() }
 func (this *RudpListener) Close() error {
+	this.lock.Lock()
+	this.closed = true
+	this.lock.Unlock()
 	this.CloseAllRudp()
 	return this.conn.Close()
 }
 func (this *RudpListener) Addr() net.Addr { return this.conn.LocalAddr() }
 
+// CloseRudp forgets the connections of addr.
 func (this *RudpListener) CloseRudp(addr string) {
 	this.lock.Lock()
-	delete(this.rudpConnMap, addr)
+	for session, rconn := range this.rudpConnMap {
+		if rconn.peer().String() == addr {
+			this.remove(session)
+		}
+	}
 	this.lock.Unlock()
 }
 
+func (this *RudpListener) remove(session uint32) {
+	if rconn, ok := this.rudpConnMap[session]; ok {
+		addr := rconn.peer().String()
+		if c, ok := this.synMap[addr]; ok && c == rconn {
+			delete(this.synMap, addr)
+		}
+		delete(this.rudpConnMap, session)
+	}
+}
+
+// CloseAllRudp closes the connections at the same time,and waits them to
+// finish lingering. They stay in the maps until closed,so the listener
+// still routes the acknowledgements of their data,the ones not established
+// are dropped at once.
 func (this *RudpListener) CloseAllRudp() {
-	this.lock.Lock()
+	this.lock.RLock()
+	conns := make([]*RudpConn, 0, len(this.rudpConnMap))
 	for _, rconn := range this.rudpConnMap {
-		rconn.closef = nil
-		rconn.Close()
+		conns = append(conns, rconn)
 	}
-	this.lock.Unlock()
+	this.lock.RUnlock()
+	var wg sync.WaitGroup
+	for _, rconn := range conns {
+		wg.Add(1)
+		go func(rconn *RudpConn) {
+			defer wg.Done()
+			if isClosed(rconn.established) {
+				rconn.Close()
+			} else {
+				rconn.teardown()
+			}
+		}(rconn)
+	}
+	wg.Wait()
 }
 func (this *RudpListener) AcceptRudp() (*RudpConn, error) {
 	select {
@@ -53,6 +101,65 @@ func (this *RudpListener) AcceptRudp() (*RudpConn, error) {
 		return nil, e
 	}
 }
+
+// newConn creates a RudpConn with an unused session.
+func (this *RudpListener) newConn(remoteAddr *net.UDPAddr, nonce uint32, version, features int) *RudpConn {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	session := newSession()
+	for this.rudpConnMap[session] != nil {
+		session = newSession()
+	}
+	closef := func(string) {
+		this.lock.Lock()
+		this.remove(session)
+		this.lock.Unlock()
+	}
+	rudp := New(this.conf)
+	rudp.Negotiate(version, features)
+	rudpConn := newUnConn(this.conn, remoteAddr, rudp, closef, session, nonce)
+	if this.conf.Key != nil {
+		rudpConn.crypt.Store(newCrypt(this.conf.Key, session, nonce, true))
+	}
+	this.rudpConnMap[session] = rudpConn
+	this.synMap[remoteAddr.String()] = rudpConn
+	return rudpConn
+}
+
+// validate sends a challenge to a new address of rudpConn,at most one per
+// ResendTime and AMPLIFICATION times the bytes received from the address,
+// and returns true if body answers it.
+func (this *RudpListener) validate(rudpConn *RudpConn, remoteAddr *net.UDPAddr, kind byte, body []byte) bool {
+	sameAddr := func(a, b *net.UDPAddr) bool { return a != nil && a.IP.Equal(b.IP) && a.Port == b.Port }
+	if kind == PACKET_RESPONSE {
+		return sameAddr(rudpConn.challengeAddr, remoteAddr) && len(body) >= PACKET_PATH &&
+			bytes.Equal(body[:PACKET_PATH], rudpConn.challenge)
+	}
+	if !sameAddr(rudpConn.challengeAddr, remoteAddr) {
+		rudpConn.challenge, rudpConn.challengeAddr, rudpConn.challengeSent = nil, remoteAddr, time.Time{}
+		rudpConn.challengeRecv, rudpConn.challengeSize = 0, 0
+	}
+	rudpConn.challengeRecv += PACKET_HEAD + len(body)
+	now := time.Now()
+	if now.Sub(rudpConn.challengeSent) < time.Duration(this.conf.ResendTime) ||
+		rudpConn.challengeSize+PACKET_HEAD+PACKET_PATH > AMPLIFICATION*rudpConn.challengeRecv {
+		return false
+	}
+	rudpConn.challenge = make([]byte, PACKET_PATH)
+	rand.Read(rudpConn.challenge)
+	rudpConn.challengeSent = now
+	p := packPacket(PACKET_CHALLENGE, rudpConn.session, rudpConn.challenge)
+	rudpConn.challengeSize += len(p)
+	_, err := this.conn.WriteToUDP(p, remoteAddr)
+	checkErr(err)
+	return false
+}
+
+// run answers a SYN with a cookie,creates a RudpConn when a SYN echoes a
+// valid one,and hands it to Accept after the first data packet of its
+// session. Packets of an unknown session are dropped,a known session from
+// a new address moves the RudpConn there after the path is validated,with
+// Config.Key or Config.PrivateKey only a sealed data packet starts it.
 func (this *RudpListener) run() {
 	data := make([]byte, MAX_PACKAGE)
 	for {
@@ -62,18 +169,118 @@ func (this *RudpListener) run() {
 			this.newRudpErr <- err
 			return
 		}
+		kind, session, body, ok := unpackPacket(data[:n])
+		if !ok {
+			continue
+		}
+		if kind == PACKET_SYN {
+			this.syn(remoteAddr, body)
+			continue
+		}
 		this.lock.RLock()
-		rudpConn, ok := this.rudpConnMap[remoteAddr.String()]
+		rudpConn, ok := this.rudpConnMap[session]
 		this.lock.RUnlock()
 		if !ok {
-			rudpConn = NewUnConn(this.conn, remoteAddr, New(), this.CloseRudp)
+			continue
+		}
+		if kind == PACKET_FINISH {
+			this.finish(rudpConn, body)
+			continue
+		}
+		if kind == PACKET_DATA {
+			if body, ok = rudpConn.open(data[:n]); !ok {
+				continue
+			}
+		}
+		trusted := kind == PACKET_DATA || this.conf.Key == nil && this.conf.PrivateKey == nil
+		if kind == PACKET_RESPONSE || trusted && rudpConn.peer().String() != remoteAddr.String() {
+			if this.validate(rudpConn, remoteAddr, kind, body) {
+				rudpConn.challenge, rudpConn.challengeAddr = nil, nil
+				rudpConn.migrate(remoteAddr)
+			}
+		}
+		if kind != PACKET_DATA {
+			continue
+		}
+		if !rudpConn.accepted {
+			rudpConn.accepted = true
 			this.lock.Lock()
-			this.rudpConnMap[remoteAddr.String()] = rudpConn
+			delete(this.synMap, rudpConn.peer().String())
 			this.lock.Unlock()
 			this.newRudpConn <- rudpConn
 		}
-		bts := make([]byte, n)
-		copy(bts, data[:n])
-		rudpConn.in <- bts
+		if this.conf.Key == nil {
+			body = append([]byte(nil), body...)
+		}
+		select {
+		case rudpConn.in <- body:
+		default:
+			//ended,or too slow
+		}
+	}
+}
+
+// finish reads the last noise message of rudpConn,its data packets are
+// sealed by the keys of the handshake from now on.
+func (this *RudpListener) finish(rudpConn *RudpConn, body []byte) {
+	hs := rudpConn.noise
+	if hs == nil {
+		return //finished,or no noise
+	}
+	saved := *hs //a forged FINISH does not break it
+	if err := hs.readMessage3(body); err != nil {
+		*hs = saved
+		rudpConn.rudp.dbg("noise finish %v,remote %v", err, rudpConn.peer())
+		return
+	}
+	rudpConn.peerKey.Store(hs.peer())
+	rudpConn.crypt.Store(hs.split())
+	rudpConn.noise = nil
+}
+
+func (this *RudpListener) syn(remoteAddr *net.UDPAddr, body []byte) {
+	nonce, cookie, valid := unpackSyn(body)
+	if !valid {
+		return
+	}
+	version, features, msg := unpackHello(body, PACKET_NONCE+PACKET_COOKIE)
+	this.lock.RLock()
+	rudpConn, ok := this.synMap[remoteAddr.String()]
+	closed := this.closed
+	this.lock.RUnlock()
+	if closed {
+		return
+	}
+	if !ok || rudpConn.nonce != nonce {
+		now := time.Now()
+		if !this.cookie.check(remoteAddr, nonce, cookie, now) {
+			retry := packSyn(nonce, this.cookie.make(remoteAddr, nonce, now))
+			_, err := this.conn.WriteToUDP(packPacket(PACKET_RETRY, 0, retry), remoteAddr)
+			checkErr(err)
+			return
+		}
+		var hs *noise
+		var hello []byte
+		if key := this.conf.PrivateKey; key != nil {
+			var err error
+			if hs, hello, err = respondNoise(key, nonce, msg); err != nil {
+				this.dbg("noise syn %v,remote %v", err, remoteAddr) //anyone can send it
+				return
+			}
+		}
+		if ok {
+			//the client restarted on the same address,nobody accepted the
+			//old conn,drop it without lingering on the run loop
+			rudpConn.teardown()
+		}
+		rudpConn = this.newConn(remoteAddr, nonce, version, features)
+		rudpConn.noise, rudpConn.hello = hs, hello
+	}
+	version, features = rudpConn.rudp.Version()
+	ack := append(packNonce(nonce), packHello(version, features, rudpConn.hello)...)
+	if key := this.conf.Key; key != nil && this.conf.PrivateKey == nil {
+		ack = append(ack, synAckTag(key, rudpConn.session, ack)...)
 	}
+	_, err := rudpConn.write(PACKET_SYN_ACK, ack)
+	checkErr(err)
 }
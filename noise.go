@@ -0,0 +1,288 @@
+package rudp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+)
+
+// with Config.PrivateKey the handshake runs Noise_XX,both sides prove they
+// hold a static x25519 key and get the one of the other,the data packets
+// are sealed by the keys it splits.
+//
+//	SYN(0,nonce,cookie,version,e)    ->
+//	                                 <-     SYN_ACK(session,nonce,version,e,ee,s,es)
+//	FINISH(session,s,se)             ->     until the server sends data
+//
+// The prologue is the nonce of the handshake.
+const (
+	NOISE_NAME = "Noise_XX_25519_AESGCM_SHA256"
+	NOISE_KEY  = 32
+	NOISE_TAG  = 16
+	NOISE_MSG1 = NOISE_KEY
+	NOISE_MSG2 = NOISE_KEY + NOISE_KEY + NOISE_TAG + NOISE_TAG
+	NOISE_MSG3 = NOISE_KEY + NOISE_TAG + NOISE_TAG
+)
+
+var errNoise = errors.New("noise handshake failed")
+
+// GenerateKey returns a new x25519 key pair for Config.PrivateKey.
+func GenerateKey() (private, public []byte, err error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key.Bytes(), key.PublicKey().Bytes(), nil
+}
+
+// noise is the handshake state of one side,see the Noise protocol
+// framework revision 34.
+type noise struct {
+	initiator bool
+	s         *ecdh.PrivateKey
+	e         *ecdh.PrivateKey
+	rs        *ecdh.PublicKey
+	re        *ecdh.PublicKey
+
+	ck []byte
+	h  []byte
+	k  cipher.AEAD //nil before the first key is mixed
+	n  uint64
+}
+
+// initiateNoise returns the state of a client and the first message.
+func initiateNoise(private []byte, nonce uint32) (*noise, []byte, error) {
+	hs, err := newNoise(private, true, packNonce(nonce))
+	if err != nil {
+		return nil, nil, err
+	}
+	msg, err := hs.writeMessage1()
+	return hs, msg, err
+}
+
+// respondNoise reads the first message of a client,and returns the state of
+// the server and the second message.
+func respondNoise(private []byte, nonce uint32, msg []byte) (*noise, []byte, error) {
+	hs, err := newNoise(private, false, packNonce(nonce))
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = hs.readMessage1(msg); err != nil {
+		return nil, nil, err
+	}
+	msg, err = hs.writeMessage2()
+	return hs, msg, err
+}
+
+func newNoise(private []byte, initiator bool, prologue []byte) (*noise, error) {
+	s, err := ecdh.X25519().NewPrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+	h := make([]byte, sha256.Size)
+	copy(h, NOISE_NAME)
+	hs := &noise{initiator: initiator, s: s, ck: h, h: h}
+	hs.mixHash(prologue)
+	return hs, nil
+}
+
+func (hs *noise) mixHash(data []byte) {
+	sum := sha256.New()
+	sum.Write(hs.h)
+	sum.Write(data)
+	hs.h = sum.Sum(nil)
+}
+
+func hkdf(ck, ikm []byte) ([]byte, []byte) {
+	mac := hmac.New(sha256.New, ck)
+	mac.Write(ikm)
+	temp := mac.Sum(nil)
+	mac = hmac.New(sha256.New, temp)
+	mac.Write([]byte{1})
+	out1 := mac.Sum(nil)
+	mac = hmac.New(sha256.New, temp)
+	mac.Write(out1)
+	mac.Write([]byte{2})
+	return out1, mac.Sum(nil)
+}
+
+func newGCM(key []byte) cipher.AEAD {
+	block, err := aes.NewCipher(key)
+	checkErr(err)
+	aead, err := cipher.NewGCM(block)
+	checkErr(err)
+	return aead
+}
+
+func (hs *noise) mixKey(ikm []byte) {
+	var k []byte
+	hs.ck, k = hkdf(hs.ck, ikm)
+	hs.k, hs.n = newGCM(k), 0
+}
+
+func (hs *noise) dh(private *ecdh.PrivateKey, public *ecdh.PublicKey) error {
+	shared, err := private.ECDH(public)
+	if err == nil {
+		hs.mixKey(shared)
+	}
+	return err
+}
+
+func (hs *noise) nonce() []byte {
+	var n [CRYPT_NUMBER]byte
+	for i := range n {
+		n[i] = byte(hs.n >> uint(8*(CRYPT_NUMBER-1-i)))
+	}
+	hs.n++
+	return gcmNonce(n[:])
+}
+
+func (hs *noise) encryptAndHash(out, plain []byte) []byte {
+	c := plain
+	if hs.k != nil {
+		c = hs.k.Seal(nil, hs.nonce(), plain, hs.h)
+	}
+	hs.mixHash(c)
+	return append(out, c...)
+}
+
+func (hs *noise) decryptAndHash(c []byte) ([]byte, error) {
+	plain := c
+	if hs.k != nil {
+		var err error
+		if plain, err = hs.k.Open(nil, hs.nonce(), c, hs.h); err != nil {
+			return nil, err
+		}
+	}
+	hs.mixHash(c)
+	return plain, nil
+}
+
+// writeE writes the ephemeral key,the first message or the start of the
+// second.
+func (hs *noise) writeE(out []byte) ([]byte, error) {
+	e, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	hs.e = e
+	hs.mixHash(e.PublicKey().Bytes())
+	return append(out, e.PublicKey().Bytes()...), nil
+}
+
+func (hs *noise) readE(msg []byte) error {
+	re, err := ecdh.X25519().NewPublicKey(msg[:NOISE_KEY])
+	if err != nil {
+		return err
+	}
+	hs.re = re
+	hs.mixHash(msg[:NOISE_KEY])
+	return nil
+}
+
+// writeMessage1 returns -> e
+func (hs *noise) writeMessage1() ([]byte, error) {
+	out, err := hs.writeE(nil)
+	if err != nil {
+		return nil, err
+	}
+	return hs.encryptAndHash(out, nil), nil
+}
+
+func (hs *noise) readMessage1(msg []byte) error {
+	if len(msg) != NOISE_MSG1 {
+		return errNoise
+	}
+	if err := hs.readE(msg); err != nil {
+		return err
+	}
+	_, err := hs.decryptAndHash(msg[NOISE_KEY:])
+	return err
+}
+
+// writeMessage2 returns <- e,ee,s,es
+func (hs *noise) writeMessage2() ([]byte, error) {
+	out, err := hs.writeE(nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := hs.dh(hs.e, hs.re); err != nil {
+		return nil, err
+	}
+	out = hs.encryptAndHash(out, hs.s.PublicKey().Bytes())
+	if err := hs.dh(hs.s, hs.re); err != nil {
+		return nil, err
+	}
+	return hs.encryptAndHash(out, nil), nil
+}
+
+func (hs *noise) readMessage2(msg []byte) error {
+	if len(msg) != NOISE_MSG2 {
+		return errNoise
+	}
+	if err := hs.readE(msg); err != nil {
+		return err
+	}
+	if err := hs.dh(hs.e, hs.re); err != nil {
+		return err
+	}
+	if err := hs.readS(msg[NOISE_KEY : 2*NOISE_KEY+NOISE_TAG]); err != nil {
+		return err
+	}
+	if err := hs.dh(hs.e, hs.rs); err != nil {
+		return err
+	}
+	_, err := hs.decryptAndHash(msg[2*NOISE_KEY+NOISE_TAG:])
+	return err
+}
+
+func (hs *noise) readS(c []byte) error {
+	s, err := hs.decryptAndHash(c)
+	if err != nil {
+		return err
+	}
+	hs.rs, err = ecdh.X25519().NewPublicKey(s)
+	return err
+}
+
+// writeMessage3 returns -> s,se
+func (hs *noise) writeMessage3() ([]byte, error) {
+	out := hs.encryptAndHash(nil, hs.s.PublicKey().Bytes())
+	if err := hs.dh(hs.s, hs.re); err != nil {
+		return nil, err
+	}
+	return hs.encryptAndHash(out, nil), nil
+}
+
+func (hs *noise) readMessage3(msg []byte) error {
+	if len(msg) != NOISE_MSG3 {
+		return errNoise
+	}
+	if err := hs.readS(msg[:NOISE_KEY+NOISE_TAG]); err != nil {
+		return err
+	}
+	if err := hs.dh(hs.e, hs.rs); err != nil {
+		return err
+	}
+	_, err := hs.decryptAndHash(msg[NOISE_KEY+NOISE_TAG:])
+	return err
+}
+
+// split returns the crypt of the data packets after the last message.
+func (hs *noise) split() *crypt {
+	k1, k2 := hkdf(hs.ck, nil)
+	c := &crypt{send: newGCM(k1), recv: newGCM(k2)}
+	if !hs.initiator {
+		c.send, c.recv = c.recv, c.send
+	}
+	return c
+}
+
+// peer returns the static public key of the remote.
+func (hs *noise) peer() []byte {
+	return hs.rs.Bytes()
+}
@@ -0,0 +1,160 @@
+package rudp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+)
+
+// every udp packet of a RudpConn starts with a kind and a session id,the
+// rudp output follows PACKET_DATA. The server keeps no state before a SYN
+// echoes the cookie of its RETRY,a SYN is as long as the RETRY it gets.
+//
+//	client                             server
+//	SYN(0,nonce,0,version)      ->
+//	                            <-     RETRY(0,nonce,cookie)
+//	SYN(0,nonce,cookie,version) ->     created
+//	                            <-     SYN_ACK(session,nonce,version)
+//	DATA(session,...)           ->     accepted
+//
+// The listener finds a RudpConn by the session,a packet from a new address
+// is answered with a challenge,and data is sent there after the response.
+//
+//	DATA(session,...)      ->     from new address
+//	                       <-     CHALLENGE(session,random)
+//	RESPONSE(session,random) ->   migrated
+const (
+	PACKET_SYN = iota + 1
+	PACKET_SYN_ACK
+	PACKET_DATA
+	PACKET_RETRY
+	PACKET_CHALLENGE
+	PACKET_RESPONSE
+	PACKET_FINISH
+)
+
+// the highest protocol version and the features a side offers follow the
+// SYN in two bytes,the SYN_ACK answers the lower version and the features
+// both sides support. Version 0 is the framing of VERSION_1 without any
+// feature,a SYN without the bytes is taken as it. The versions start here,
+// a rudp from before does not get on,the packet header and the message types
+// of it differ.
+const (
+	VERSION_0 = iota
+	VERSION_1 //features
+
+	PROTOCOL_VERSION = VERSION_1
+)
+
+const (
+	FEATURE_WIDE_ID  = 1 << iota //32 bit message ids,since VERSION_1
+	FEATURE_CHECKSUM             //crc32c of every package,since VERSION_1
+
+	FEATURES = FEATURE_WIDE_ID | FEATURE_CHECKSUM
+)
+
+// versionFeatures returns the features a version knows
+func versionFeatures(version int) int {
+	if version < VERSION_1 {
+		return 0
+	}
+	return FEATURES
+}
+
+// an address not validated gets at most AMPLIFICATION times the bytes
+// received from it,a RETRY is no longer than the SYN.
+const AMPLIFICATION = 3
+
+const (
+	PACKET_HEAD    = 5
+	PACKET_NONCE   = 4
+	PACKET_COOKIE  = 4 + COOKIE_MAC
+	PACKET_PATH    = 8
+	PACKET_VERSION = 2
+)
+
+func newSession() uint32 {
+	var b [4]byte
+	for {
+		rand.Read(b[:])
+		if id := binary.BigEndian.Uint32(b[:]); id != 0 {
+			return id
+		}
+	}
+}
+
+func packPacket(kind byte, session uint32, bts []byte) []byte {
+	p := make([]byte, PACKET_HEAD+len(bts))
+	p[0] = kind
+	binary.BigEndian.PutUint32(p[1:], session)
+	copy(p[PACKET_HEAD:], bts)
+	return p
+}
+
+func unpackPacket(bts []byte) (kind byte, session uint32, body []byte, ok bool) {
+	if len(bts) < PACKET_HEAD {
+		return
+	}
+	return bts[0], binary.BigEndian.Uint32(bts[1:]), bts[PACKET_HEAD:], true
+}
+
+func packNonce(nonce uint32) []byte {
+	b := make([]byte, PACKET_NONCE)
+	binary.BigEndian.PutUint32(b, nonce)
+	return b
+}
+
+func unpackNonce(body []byte) (uint32, bool) {
+	if len(body) < PACKET_NONCE {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(body), true
+}
+
+// packSyn returns [nonce 4][cookie 20],the cookie is zero before a RETRY.
+func packSyn(nonce uint32, cookie []byte) []byte {
+	b := make([]byte, PACKET_NONCE+PACKET_COOKIE)
+	binary.BigEndian.PutUint32(b, nonce)
+	copy(b[PACKET_NONCE:], cookie)
+	return b
+}
+
+func unpackSyn(body []byte) (nonce uint32, cookie []byte, ok bool) {
+	if len(body) < PACKET_NONCE+PACKET_COOKIE {
+		return
+	}
+	return binary.BigEndian.Uint32(body), body[PACKET_NONCE : PACKET_NONCE+PACKET_COOKIE], true
+}
+
+// packVersion returns [version 1][features 1],nothing for VERSION_0.
+func packVersion(version, features int) []byte {
+	if version == VERSION_0 {
+		return nil
+	}
+	return []byte{byte(version), byte(features)}
+}
+
+// packHello returns the version and features,followed by the noise message
+// if there is one.
+func packHello(version, features int, msg []byte) []byte {
+	if msg == nil {
+		return packVersion(version, features)
+	}
+	return append([]byte{byte(version), byte(features)}, msg...)
+}
+
+func unpackHello(body []byte, at int) (version, features int, msg []byte) {
+	version, features = unpackVersion(body, at)
+	if len(body) > at+PACKET_VERSION {
+		msg = body[at+PACKET_VERSION:]
+	}
+	return
+}
+
+// unpackVersion returns the version and features at,VERSION_0 if body ends
+// before.
+func unpackVersion(body []byte, at int) (version, features int) {
+	if len(body) < at+PACKET_VERSION {
+		return VERSION_0, 0
+	}
+	return int(body[at]), int(body[at+1])
+}
@@ -0,0 +1,92 @@
+package rudp
+
+import "time"
+
+// Path mtu discovery like RFC 8899,the output starts with GENERAL_PACKAGE
+// byte packages,and padded probes binary search a larger size up to
+// MaxPacketSize. A probe not acknowledged PROBE_MAX times lowers the upper
+// bound,a resend timeout confirms the size in use by a probe of it,and
+// falls back to GENERAL_PACKAGE if that one is lost PROBE_MAX times.
+const (
+	PROBE_MAX       = 3
+	PMTU_RAISE_TIME = 600e9 //search again for a larger size after n nanosecond
+)
+
+func (r *Rudp) sendProbe(tmp *packageBuffer) {
+	nano := time.Now().UnixNano()
+	if r.rtt == 0 {
+		return //until the remote answers
+	}
+	if r.probe != 0 && r.probeSent != 0 {
+		if nano < r.probeSent+r.rto {
+			return
+		}
+		if r.probeLost++; r.probeLost >= PROBE_MAX {
+			r.dbg("probe %v lost,pmtu %v", r.probe, r.pmtu)
+			r.pmtuHigh = r.probe - 1
+			if r.probe <= r.pmtu {
+				r.dbg("black hole,pmtu %v fall back to %v", r.pmtu, GENERAL_PACKAGE)
+				r.pmtu = GENERAL_PACKAGE
+			}
+			r.probe, r.probeLost = 0, 0
+			r.endSearch(nano)
+		}
+	}
+	if r.probe == 0 {
+		if r.pmtuHigh <= r.pmtu {
+			if nano < r.pmtuSearched+PMTU_RAISE_TIME || r.conf.MaxPacketSize <= r.pmtu {
+				return
+			}
+			r.pmtuHigh = r.conf.MaxPacketSize
+		}
+		r.probe = (r.pmtu + r.pmtuHigh + 1) / 2
+	}
+	r.probeSent = nano
+	tmp.packProbe(TYPE_PROBE, r.probe)
+}
+
+func (r *Rudp) endSearch(nano int64) {
+	if r.pmtuHigh <= r.pmtu {
+		r.pmtuSearched = nano
+		r.dbg("pmtu %v", r.pmtu)
+	}
+}
+
+func (r *Rudp) addProbe(size int) {
+	if size > r.probeAck {
+		r.probeAck = size
+	}
+}
+
+func (r *Rudp) ackProbe(tmp *packageBuffer) {
+	if r.probeAck > 0 {
+		tmp.packProbe(TYPE_PROBE_ACK, r.probeAck)
+		r.probeAck = 0
+	}
+}
+
+func (r *Rudp) addProbeAck(size int) {
+	if size != r.probe {
+		return
+	}
+	r.pmtu = size
+	r.probe, r.probeLost = 0, 0
+	r.endSearch(time.Now().UnixNano())
+}
+
+// checkBlackHole probes the size in use after a resend timeout,instead of
+// a larger one being searched. Acknowledgements of smaller packages do not
+// stop it,only the probe tells if packages of the size still get through.
+func (r *Rudp) checkBlackHole() {
+	if r.pmtu <= GENERAL_PACKAGE || r.probe == r.pmtu {
+		return
+	}
+	r.probe, r.probeLost, r.probeSent = r.pmtu, 0, 0
+}
+
+// PMTU returns the package size used by the output.
+func (r *Rudp) PMTU() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.pmtu
+}
@@ -2,7 +2,8 @@ package rudp
 
 import (
 	"bytes"
-	"errors"
+	"io"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -13,21 +14,70 @@ const (
 	TYPE_CORRUPT
 	TYPE_REQUEST
 	TYPE_MISSING
+	TYPE_FRAGMENT
+	TYPE_ACK
+	TYPE_TIME
+	TYPE_TIME_ECHO
+	TYPE_PROBE
+	TYPE_PROBE_ACK
 	TYPE_NORMAL
 )
 
+// a fragmented message is sent as several messages,each one is preceded by
+// TYPE_FRAGMENT and one of these flags
 const (
-	MAX_MSG_HEAD    = 4
-	GENERAL_PACKAGE = 576 - 60 - 8
-	MAX_PACKAGE     = 0x7fff - TYPE_NORMAL
+	FRAGMENT_NONE = iota
+	FRAGMENT_FIRST
+	FRAGMENT_MIDDLE
+	FRAGMENT_LAST
 )
 
 const (
-	ERROR_NIL int32 = iota
-	ERROR_EOF
-	ERROR_REMOTE_EOF
-	ERROR_CORRUPT
-	ERROR_MSG_SIZE
+	MAX_MSG_HEAD      = 6 //length 2,id 4
+	MAX_FRAGMENT_HEAD = 2
+	GENERAL_PACKAGE   = 576 - 60 - 8
+	MAX_PACKAGE       = 0x7fff - TYPE_NORMAL
+	MAX_FRAGMENT      = GENERAL_PACKAGE - MAX_MSG_HEAD - MAX_FRAGMENT_HEAD
+	TIME_INTERVAL     = 1e8    //send TYPE_TIME every n nanosecond to measure rtt
+	REQUEST_MAX_NUM   = 1 << 8 //messages sent again for one request at most
+	INITIAL_WINDOW    = 8      //messages sent before the window of the remote is known
+)
+
+// the reason a Rudp stops,Error.Err returns the error of it
+const (
+	ERROR_NIL        int32 = iota
+	ERROR_EOF              //closed here
+	ERROR_REMOTE_EOF       //aborted by the remote
+	ERROR_CORRUPT          //nothing received in time
+	ERROR_MSG_SIZE         //malformed input
+	ERROR_TOO_LARGE        //reassembled message more than MaxMessageSize
+)
+
+// opError is the type of the errors returned by rudp,it implements net.Error.
+type opError struct {
+	msg     string
+	timeout bool
+}
+
+func (e *opError) Error() string   { return e.msg }
+func (e *opError) Timeout() bool   { return e.timeout }
+func (e *opError) Temporary() bool { return e.timeout }
+
+var (
+	// ErrClosed is returned by Send after CloseWrite,and by a closed RudpConn.
+	ErrClosed error = &opError{msg: "use of closed connection"}
+	// ErrRemoteClosed is returned after the remote aborted the connection,
+	// a graceful close is io.EOF.
+	ErrRemoteClosed error = &opError{msg: "connection aborted by remote"}
+	// ErrTimeout is returned when nothing is received in CorruptTick,the
+	// handshake or Close does not finish in time.
+	ErrTimeout error = &opError{msg: "connection timeout", timeout: true}
+	// ErrProtocol is returned after malformed input.
+	ErrProtocol error = &opError{msg: "protocol error"}
+	// ErrMessageTooLarge is returned for a message more than MaxMessageSize.
+	ErrMessageTooLarge error = &opError{msg: "message too large"}
+	// ErrWouldBlock is returned by Send when the remote receive window is full.
+	ErrWouldBlock error = &opError{msg: "would block"}
 )
 
 type Error struct {
@@ -37,16 +87,19 @@ type Error struct {
 func (e *Error) Load() int32   { return atomic.LoadInt32(&e.v) }
 func (e *Error) Store(n int32) { atomic.StoreInt32(&e.v, n) }
 
-func (e *Error) Error() error {
+// Err returns the error of the stored reason,nil for ERROR_NIL.
+func (e *Error) Err() error {
 	switch e.Load() {
 	case ERROR_EOF:
-		return errors.New("EOF")
+		return ErrClosed
 	case ERROR_REMOTE_EOF:
-		return errors.New("remote EOF")
+		return ErrRemoteClosed
 	case ERROR_CORRUPT:
-		return errors.New("corrupt")
+		return ErrTimeout
 	case ERROR_MSG_SIZE:
-		return errors.New("recive msg size error")
+		return ErrProtocol
+	case ERROR_TOO_LARGE:
+		return ErrMessageTooLarge
 	default:
 		return nil
 	}
@@ -58,21 +111,56 @@ type Package struct {
 }
 
 type packageBuffer struct {
-	tmp  bytes.Buffer
-	num  int
-	head *Package
-	tail *Package
+	size     int //max package size
+	idSize   int //bytes of a message id
+	checksum bool
+	tmp      bytes.Buffer
+	num      int
+	head     *Package
+	tail     *Package
 }
 
 func (tmp *packageBuffer) packRequest(min, max int, tag int) {
-	if tmp.tmp.Len()+5 > GENERAL_PACKAGE {
+	if tmp.tmp.Len()+1+2*tmp.idSize > tmp.size {
+		tmp.newPackage()
+	}
+	tmp.tmp.WriteByte(byte(tag))
+	tmp.writeID(min)
+	tmp.writeID(max)
+}
+func (tmp *packageBuffer) packAck(id, wnd int) {
+	if tmp.tmp.Len()+3+tmp.idSize > tmp.size {
+		tmp.newPackage()
+	}
+	tmp.tmp.WriteByte(byte(TYPE_ACK))
+	tmp.writeID(id)
+	tmp.tmp.WriteByte(byte((wnd & 0xff00) >> 8))
+	tmp.tmp.WriteByte(byte(wnd & 0xff))
+}
+func (tmp *packageBuffer) packTime(tag int, us uint32) {
+	if tmp.tmp.Len()+5 > tmp.size {
 		tmp.newPackage()
 	}
 	tmp.tmp.WriteByte(byte(tag))
-	tmp.tmp.WriteByte(byte((min & 0xff00) >> 8))
-	tmp.tmp.WriteByte(byte(min & 0xff))
-	tmp.tmp.WriteByte(byte((max & 0xff00) >> 8))
-	tmp.tmp.WriteByte(byte(max & 0xff))
+	tmp.tmp.WriteByte(byte(us >> 24))
+	tmp.tmp.WriteByte(byte(us >> 16))
+	tmp.tmp.WriteByte(byte(us >> 8))
+	tmp.tmp.WriteByte(byte(us))
+}
+
+// packProbe writes a probe padded to size in a package of its own,or the
+// acknowledgement of it.
+func (tmp *packageBuffer) packProbe(tag int, size int) {
+	if tag == TYPE_PROBE || tmp.tmp.Len()+3 > tmp.size {
+		tmp.newPackage()
+	}
+	tmp.tmp.WriteByte(byte(tag))
+	tmp.tmp.WriteByte(byte((size & 0xff00) >> 8))
+	tmp.tmp.WriteByte(byte(size & 0xff))
+	if tag == TYPE_PROBE {
+		tmp.tmp.Write(make([]byte, size-3))
+		tmp.newPackage()
+	}
 }
 func (tmp *packageBuffer) fillHeader(head, id int) {
 	if head < 128 {
@@ -81,13 +169,33 @@ func (tmp *packageBuffer) fillHeader(head, id int) {
 		tmp.tmp.WriteByte(byte(((head & 0x7f00) >> 8) | 0x80))
 		tmp.tmp.WriteByte(byte(head & 0xff))
 	}
-	tmp.tmp.WriteByte(byte((id & 0xff00) >> 8))
-	tmp.tmp.WriteByte(byte(id & 0xff))
+	tmp.writeID(id)
+}
+
+// writeID writes the low idSize bytes of id
+func (tmp *packageBuffer) writeID(id int) {
+	for i := tmp.idSize - 1; i >= 0; i-- {
+		tmp.tmp.WriteByte(byte(id >> uint(8*i)))
+	}
 }
 func (tmp *packageBuffer) packMessage(m *message) {
-	if m.buf.Len()+4+tmp.tmp.Len() >= GENERAL_PACKAGE {
+	head := MAX_MSG_HEAD
+	if m.frag != FRAGMENT_NONE {
+		head += MAX_FRAGMENT_HEAD
+	}
+	if m.eof {
+		head++
+	}
+	if m.buf.Len()+head+tmp.tmp.Len() >= tmp.size {
 		tmp.newPackage()
 	}
+	if m.frag != FRAGMENT_NONE {
+		tmp.tmp.WriteByte(byte(TYPE_FRAGMENT))
+		tmp.tmp.WriteByte(byte(m.frag))
+	}
+	if m.eof {
+		tmp.tmp.WriteByte(byte(TYPE_EOF))
+	}
 	tmp.fillHeader(m.buf.Len()+TYPE_NORMAL, m.id)
 	tmp.tmp.Write(m.buf.Bytes())
 }
@@ -98,6 +206,9 @@ func (tmp *packageBuffer) newPackage() {
 	p := &Package{Bts: make([]byte, tmp.tmp.Len())}
 	copy(p.Bts, tmp.tmp.Bytes())
 	tmp.tmp.Reset()
+	if tmp.checksum {
+		p.Bts = appendChecksum(p.Bts)
+	}
 	tmp.num++
 	if tmp.tail == nil {
 		tmp.head = p
@@ -108,21 +219,81 @@ func (tmp *packageBuffer) newPackage() {
 	}
 }
 
-func New() *Rudp {
-	return &Rudp{reqSendAgain: make(chan [2]int, 1<<10), addSendAgain: make(chan [2]int, 1<<10), recvSkip: make(map[int]int)}
+// New creates a Rudp with the given config,DefaultConfig if there is none.
+func New(conf ...Config) *Rudp {
+	c := DefaultConfig()
+	if len(conf) > 0 {
+		c = conf[0]
+	}
+	r := &Rudp{conf: c, recvSkip: make(map[int]int64),
+		reqSendAgain: make(chan [2]int, 1<<10), addSendAgain: make(chan [2]int, 1<<10),
+		rto: int64(c.ResendTime), missing: int64(c.MissingTime), sendLimit: INITIAL_WINDOW, idSize: 2,
+		pmtu: GENERAL_PACKAGE, pmtuHigh: c.MaxPacketSize}
+	if c.Window < r.sendLimit {
+		r.sendLimit = c.Window
+	}
+	r.timeSent = time.Now().UnixNano()
+	r.ackSent = r.timeSent
+	if c.Congestion != nil {
+		r.cc = c.Congestion()
+	}
+	return r
 }
 
+// Rudp is safe for concurrent use,usually Input and Recv are called by the
+// receiving goroutine,Send and Update by the sending one.
 type Rudp struct {
+	conf Config
+	lock sync.Mutex
+
 	recvQueue    messageQueue
-	recvSkip     map[int]int
+	recvSkip     map[int]int64
 	reqSendAgain chan [2]int
 	recvIDMin    int
 	recvIDMax    int
+	recvFrag     *bytes.Buffer
+	recvAck      bool
+	ackSent      int64
+	recvEOF      bool
 
 	sendQueue    messageQueue
 	sendHistory  messageQueue
 	addSendAgain chan [2]int
 	sendID       int
+	sendAckID    int
+	sendLimit    int //remote window allows sending id before it
+	sendBackoff  uint
+	resendStart  int64 //the TIME_INTERVAL resendSize is counted in
+	resendSize   int   //bytes sent again on requests and timeouts
+	sendEOF      bool
+	inflight     int //bytes sent and not acknowledged
+	cc           Congestion
+
+	//path mtu discovery,package size in byte
+	pmtu         int   //confirmed
+	pmtuHigh     int   //the largest that may get through
+	pmtuSearched int64 //time the search ended
+	probe        int   //being probed,0 if none
+	probeSent    int64
+	probeLost    int
+	probeAck     int //received,to acknowledge
+
+	//rtt in nanosecond,rto and missing are derived from it
+	rtt      int64
+	rttVar   int64
+	rto      int64
+	missing  int64
+	timeSent int64
+	timeEcho uint32 //remote time to echo,in microsecond
+	timeRecv int64
+	echo     bool
+
+	//negotiated protocol,the encoding depends on it
+	version  int
+	features int
+	idSize   int //bytes of a message id on the wire
+
+	badPackages int //dropped by checksum
 
 	corrupt Error
 
@@ -132,59 +303,169 @@ type Rudp struct {
 	lastSendDelayTick int
 }
 
+// Recv returns io.EOF after the remote called CloseWrite and every message
+// before was received,io.ErrShortBuffer if bts is too small for a message.
 func (r *Rudp) Recv(bts []byte) (int, error) {
-	if err := r.corrupt.Load(); err != ERROR_NIL {
-		return 0, r.corrupt.Error()
+	data, err := r.recv()
+	if data == nil {
+		return 0, err
 	}
-	m := r.recvQueue.pop(r.recvIDMin)
-	if m == nil {
-		return 0, nil
+	if n := copy(bts, data); n < len(data) {
+		return n, io.ErrShortBuffer
 	}
-	r.recvIDMin++
-	copy(bts, m.buf.Bytes())
-	return m.buf.Len(), nil
+	return len(data), nil
 }
 
-func (r *Rudp) Send(bts []byte) (n int, err error) {
+// recv return the next whole message,fragments are joined together,
+// nil if there is none
+func (r *Rudp) recv() ([]byte, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.recvEOF {
+		return nil, io.EOF
+	}
 	if err := r.corrupt.Load(); err != ERROR_NIL {
-		return 0, r.corrupt.Error()
+		return nil, r.corrupt.Err()
 	}
-	if len(bts) > MAX_PACKAGE {
-		return 0, nil
+	for {
+		m := r.recvQueue.pop(r.recvIDMin)
+		if m == nil {
+			return nil, nil
+		}
+		r.recvIDMin++
+		r.recvAck = true //window changed
+		if m.eof && r.recvFrag == nil {
+			r.recvEOF = true
+			return nil, io.EOF
+		}
+		if (r.recvFrag == nil) != (m.frag == FRAGMENT_NONE || m.frag == FRAGMENT_FIRST) {
+			r.dbg("recv fragment %v out of order,id %v", m.frag, m.id)
+			r.corrupt.Store(ERROR_MSG_SIZE)
+			return nil, r.corrupt.Err()
+		}
+		if m.frag == FRAGMENT_NONE {
+			return append([]byte{}, m.buf.Bytes()...), nil
+		}
+		if m.frag == FRAGMENT_FIRST {
+			r.recvFrag = &bytes.Buffer{}
+		}
+		if r.recvFrag.Len()+m.buf.Len() > r.conf.MaxMessageSize {
+			r.dbg("recv fragment message more than %v", r.conf.MaxMessageSize)
+			r.corrupt.Store(ERROR_TOO_LARGE)
+			return nil, r.corrupt.Err()
+		}
+		r.recvFrag.Write(m.buf.Bytes())
+		if m.frag == FRAGMENT_LAST {
+			data := r.recvFrag.Bytes()
+			r.recvFrag = nil
+			return data, nil
+		}
 	}
+}
+
+// Send queues a message,one longer than MAX_FRAGMENT is sent as fragments
+// and joined together by the remote Recv. It returns ErrMessageTooLarge if
+// bts is longer than MaxMessageSize,ErrWouldBlock if the remote window is full.
+func (r *Rudp) Send(bts []byte) (n int, err error) {
 	m := &message{}
 	m.buf.Write(bts)
+	if err := r.send(m); err != nil {
+		return 0, err
+	}
+	return len(bts), nil
+}
+
+func (r *Rudp) send(m *message) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if err := r.corrupt.Load(); err != ERROR_NIL {
+		return r.corrupt.Err()
+	}
+	if r.sendEOF {
+		return ErrClosed
+	}
+	if m.buf.Len() > r.conf.MaxMessageSize {
+		return ErrMessageTooLarge
+	}
+	if r.sendID >= r.sendLimit {
+		return ErrWouldBlock
+	}
+	if m.frag != FRAGMENT_NONE || m.buf.Len() <= MAX_FRAGMENT {
+		r.push(m)
+		return nil
+	}
+	bts := m.buf.Bytes()
+	for n := 0; n < len(bts); n += MAX_FRAGMENT {
+		f := &message{frag: FRAGMENT_MIDDLE}
+		if n == 0 {
+			f.frag = FRAGMENT_FIRST
+		}
+		if n+MAX_FRAGMENT >= len(bts) {
+			f.frag = FRAGMENT_LAST
+			f.buf.Write(bts[n:])
+		} else {
+			f.buf.Write(bts[n : n+MAX_FRAGMENT])
+		}
+		r.push(f)
+	}
+	return nil
+}
+
+// push queues a message,the window only limits when it is sent.
+func (r *Rudp) push(m *message) {
 	m.id = r.sendID
 	r.sendID++
+	r.sendEOF = m.eof
 	m.tick = r.currentTick
 	r.sendQueue.push(m)
-	return len(bts), nil
 }
 
 func (r *Rudp) Update(tick int) *Package {
+	r.lock.Lock()
+	defer r.lock.Unlock()
 	if r.corrupt.Load() != ERROR_NIL {
 		return nil
 	}
 	r.currentTick += tick
-	if r.currentTick >= r.lastExpiredTick+expiredTick {
+	if r.currentTick >= r.lastExpiredTick+r.conf.ExpiredTick {
 		r.lastExpiredTick = r.currentTick
 		r.clearSendExpired()
 	}
-	if r.currentTick >= r.lastRecvTick+corruptTick {
+	if r.currentTick >= r.lastRecvTick+r.conf.CorruptTick {
 		r.corrupt.Store(ERROR_CORRUPT)
 	}
-	if r.currentTick >= r.lastSendDelayTick+sendDelayTick {
+	if r.currentTick >= r.lastSendDelayTick+r.conf.SendDelayTick {
 		r.lastSendDelayTick = r.currentTick
 		return r.outPut()
 	}
 	return nil
 }
 
+// CloseWrite sends a FIN after the messages sent before,the remote Recv
+// returns io.EOF after them. Send returns ErrClosed from now on.
+func (r *Rudp) CloseWrite() error { return r.send(&message{eof: true}) }
+
+// Flushed returns true when every message sent is acknowledged.
+func (r *Rudp) Flushed() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.sendAckID == r.sendID
+}
+
+func (r *Rudp) eof() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.recvEOF
+}
+
 type message struct {
 	next *message
 	buf  bytes.Buffer
 	id   int
 	tick int
+	frag int
+	eof  bool  //FIN,preceded by TYPE_EOF
+	sent int64 //last send time in nanosecond
 }
 
 type messageQueue struct {
@@ -221,27 +502,61 @@ func (r *messageQueue) push(m *message) {
 	r.num++
 }
 
-func (r *Rudp) getID(max int, bt1, bt2 byte) int {
-	n1, n2 := int(bt1), int(bt2)
-	id := n1*256 + n2
-	id |= max & ^0xffff
-	if id < max-0x8000 {
-		id += 0x10000
-		dbg("id < max-0x8000 ,net %v,id %v,min %v,max %v,cur %v",
-			n1*256+n2, id, r.recvIDMin, max, id+0x10000)
-	} else if id > max+0x8000 {
-		id -= 0x10000
-		dbg("id > max-0x8000 ,net %v,id %v,min %v,max %v,cur %v",
-			n1*256+n2, id, r.recvIDMin, max, id+0x10000)
+// getID returns the id nearest to max whose low bytes are bts,it counts in
+// int64 as 1<<32 does not fit a 32 bit int.
+func (r *Rudp) getID(max int, bts []byte) int {
+	var n int64
+	for _, b := range bts[:r.idSize] {
+		n = n<<8 | int64(b)
+	}
+	full := int64(1) << uint(8*r.idSize)
+	half := full >> 1
+	id := n | int64(max)&^(full-1)
+	if id < int64(max)-half {
+		id += full
+		r.dbg("id < max-%v ,net %v,id %v,min %v,max %v", half, n, id, r.recvIDMin, max)
+	} else if id > int64(max)+half {
+		id -= full
+		r.dbg("id > max+%v ,net %v,id %v,min %v,max %v", half, n, id, r.recvIDMin, max)
+	}
+	return int(id)
+}
+
+// Negotiate selects the encoding of the lower version of the remote and
+// Config.Version,and the features both sides support. It is called before
+// any message is sent or received,a Rudp starts at VERSION_0.
+func (r *Rudp) Negotiate(version, features int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if version > r.conf.Version {
+		version = r.conf.Version
+	}
+	r.version = version
+	r.features = features & r.conf.Features & versionFeatures(version)
+	r.idSize = 2
+	if r.features&FEATURE_WIDE_ID != 0 {
+		r.idSize = 4
 	}
-	return id
+}
+
+// Version returns the negotiated protocol version and features.
+func (r *Rudp) Version() (version, features int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.version, r.features
 }
 
 func (r *Rudp) outPut() *Package {
-	var tmp packageBuffer
+	tmp := packageBuffer{size: r.pmtu, idSize: r.idSize,
+		checksum: r.features&FEATURE_CHECKSUM != 0}
 	r.reqMissing(&tmp)
+	r.ackRecv(&tmp)
+	r.ackProbe(&tmp)
+	r.sendTime(&tmp)
 	r.replyRequest(&tmp)
+	r.resendTimeout(&tmp)
 	r.sendMessage(&tmp)
+	r.sendProbe(&tmp)
 	if tmp.head == nil && tmp.tmp.Len() == 0 {
 		tmp.tmp.WriteByte(byte(TYPE_PING))
 	}
@@ -249,11 +564,32 @@ func (r *Rudp) outPut() *Package {
 	return tmp.head
 }
 
+// abortPackage returns a package telling the remote to stop at once
+func (r *Rudp) abortPackage() []byte {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	tmp := packageBuffer{checksum: r.features&FEATURE_CHECKSUM != 0}
+	tmp.tmp.WriteByte(byte(TYPE_CORRUPT))
+	tmp.newPackage()
+	return tmp.head.Bts
+}
+
 func (r *Rudp) Input(bts []byte) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.features&FEATURE_CHECKSUM != 0 {
+		var ok bool
+		if bts, ok = verifyChecksum(bts); !ok {
+			r.badPackages++
+			r.dbg("drop bad package,num %v", r.badPackages)
+			return
+		}
+	}
 	sz := len(bts)
 	if sz > 0 {
 		r.lastRecvTick = r.currentTick
 	}
+	frag, eof := FRAGMENT_NONE, false
 	for sz > 0 {
 		len := int(bts[0])
 		if len > 127 {
@@ -268,16 +604,20 @@ func (r *Rudp) Input(bts []byte) {
 			bts = bts[1:]
 			sz -= 1
 		}
+		if (frag != FRAGMENT_NONE || eof) && len < TYPE_NORMAL {
+			r.corrupt.Store(ERROR_MSG_SIZE)
+			return
+		}
 		switch len {
 		case TYPE_PING:
 			r.checkMissing(false)
 		case TYPE_EOF:
-			r.corrupt.Store(ERROR_EOF)
+			eof = true
 		case TYPE_CORRUPT:
 			r.corrupt.Store(ERROR_REMOTE_EOF)
 			return
 		case TYPE_REQUEST, TYPE_MISSING:
-			if sz < 4 {
+			if sz < 2*r.idSize {
 				r.corrupt.Store(ERROR_MSG_SIZE)
 				return
 			}
@@ -287,18 +627,67 @@ func (r *Rudp) Input(bts []byte) {
 				exe = r.addMissing
 				max = r.recvIDMax
 			}
-			exe(r.getID(max, bts[0], bts[1]), r.getID(max, bts[2], bts[3]))
+			exe(r.getID(max, bts), r.getID(max, bts[r.idSize:]))
+			bts = bts[2*r.idSize:]
+			sz -= 2 * r.idSize
+		case TYPE_FRAGMENT:
+			if sz < 1 || bts[0] == FRAGMENT_NONE || bts[0] > FRAGMENT_LAST {
+				r.corrupt.Store(ERROR_MSG_SIZE)
+				return
+			}
+			frag = int(bts[0])
+			bts = bts[1:]
+			sz -= 1
+		case TYPE_ACK:
+			if sz < r.idSize+2 {
+				r.corrupt.Store(ERROR_MSG_SIZE)
+				return
+			}
+			r.addAck(r.getID(r.sendID, bts), int(bts[r.idSize])<<8|int(bts[r.idSize+1]))
+			bts = bts[r.idSize+2:]
+			sz -= r.idSize + 2
+		case TYPE_PROBE, TYPE_PROBE_ACK:
+			if sz < 2 {
+				r.corrupt.Store(ERROR_MSG_SIZE)
+				return
+			}
+			size := int(bts[0])<<8 | int(bts[1])
+			bts = bts[2:]
+			sz -= 2
+			if len == TYPE_PROBE {
+				if size < 3 || sz < size-3 {
+					r.corrupt.Store(ERROR_MSG_SIZE)
+					return
+				}
+				r.addProbe(size)
+				bts = bts[size-3:]
+				sz -= size - 3
+			} else {
+				r.addProbeAck(size)
+			}
+		case TYPE_TIME, TYPE_TIME_ECHO:
+			if sz < 4 {
+				r.corrupt.Store(ERROR_MSG_SIZE)
+				return
+			}
+			us := uint32(bts[0])<<24 | uint32(bts[1])<<16 | uint32(bts[2])<<8 | uint32(bts[3])
+			if len == TYPE_TIME {
+				r.timeEcho, r.timeRecv, r.echo = us, time.Now().UnixNano(), true
+			} else {
+				r.addRTT(us)
+			}
 			bts = bts[4:]
 			sz -= 4
 		default:
 			len -= TYPE_NORMAL
-			if sz < len+2 {
+			if sz < len+r.idSize {
 				r.corrupt.Store(ERROR_MSG_SIZE)
 				return
 			}
-			r.insertMessage(r.getID(r.recvIDMax, bts[0], bts[1]), bts[2:len+2])
-			bts = bts[len+2:]
-			sz -= len + 2
+			r.insertMessage(r.getID(r.recvIDMax, bts), bts[r.idSize:len+r.idSize], frag, eof)
+			frag, eof = FRAGMENT_NONE, false
+			bts = bts[len+r.idSize:]
+			sz -= len + r.idSize
 		}
 	}
 	r.checkMissing(false)
@@ -307,28 +696,39 @@ func (r *Rudp) Input(bts []byte) {
 func (r *Rudp) checkMissing(direct bool) {
 	head := r.recvQueue.head
 	if head != nil && head.id > r.recvIDMin {
-		nano := int(time.Now().UnixNano())
+		nano := time.Now().UnixNano()
 		last := r.recvSkip[r.recvIDMin]
 		if !direct && last == 0 {
 			r.recvSkip[r.recvIDMin] = nano
-			dbg("miss start %v-%v,max %v", r.recvIDMin, head.id-1, r.recvIDMax)
-		} else if direct || last+missingTime < nano {
-			delete(r.recvSkip, r.recvIDMin)
-			r.reqSendAgain <- [2]int{r.recvIDMin, head.id - 1}
-			dbg("req miss %v-%v,direct %v,wait num %v",
+			r.dbg("miss start %v-%v,max %v", r.recvIDMin, head.id-1, r.recvIDMax)
+		} else if direct || last+r.missing < nano {
+			//wait a resend timeout before asking again
+			r.recvSkip[r.recvIDMin] = nano + r.rto - r.missing
+			select {
+			case r.reqSendAgain <- [2]int{r.recvIDMin, head.id - 1}:
+			default:
+				r.dbg("req miss %v-%v,queue full", r.recvIDMin, head.id-1)
+				return
+			}
+			r.dbg("req miss %v-%v,direct %v,wait num %v",
 				r.recvIDMin, head.id-1, direct, r.recvQueue.num)
 		}
 	}
 }
 
-func (r *Rudp) insertMessage(id int, bts []byte) {
+func (r *Rudp) insertMessage(id int, bts []byte, frag int, eof bool) {
+	r.recvAck = true
 	if id < r.recvIDMin {
-		dbg("already recv %v,len %v", id, len(bts))
+		r.dbg("already recv %v,len %v", id, len(bts))
+		return
+	}
+	if id >= r.recvIDMin+r.conf.Window {
+		r.dbg("recv %v out of window,min %v", id, r.recvIDMin)
 		return
 	}
 	delete(r.recvSkip, id)
 	if id > r.recvIDMax || r.recvQueue.head == nil {
-		m := &message{}
+		m := &message{frag: frag, eof: eof}
 		m.buf.Write(bts)
 		m.id = id
 		r.recvQueue.push(m)
@@ -338,9 +738,9 @@ func (r *Rudp) insertMessage(id int, bts []byte) {
 		last := &r.recvQueue.head
 		for m != nil {
 			if m.id == id {
-				dbg("repeat recv id %v,len %v", id, len(bts))
+				r.dbg("repeat recv id %v,len %v", id, len(bts))
 			} else if m.id > id {
-				tmp := &message{}
+				tmp := &message{frag: frag, eof: eof}
 				tmp.buf.Write(bts)
 				tmp.id = id
 				tmp.next = m
@@ -355,67 +755,142 @@ func (r *Rudp) insertMessage(id int, bts []byte) {
 }
 
 func (r *Rudp) sendMessage(tmp *packageBuffer) {
-	m := r.sendQueue.head
-	for m != nil {
+	nano := time.Now().UnixNano()
+	for m := r.sendQueue.head; m != nil; m = r.sendQueue.head {
+		if m.id >= r.sendLimit {
+			r.dbg("window limit %v,wait num %v", r.sendLimit, r.sendQueue.num)
+			break
+		}
+		if r.cc != nil && r.cc.Allow(r.inflight, nano) <= 0 {
+			r.dbg("congestion limit,inflight %v,wait num %v", r.inflight, r.sendQueue.num)
+			break
+		}
+		r.sendQueue.pop(-1)
 		tmp.packMessage(m)
-		m = m.next
-	}
-	if r.sendQueue.head != nil {
-		if r.sendHistory.tail == nil {
-			r.sendHistory = r.sendQueue
-		} else {
-			r.sendHistory.tail.next = r.sendQueue.head
-			r.sendHistory.tail = r.sendQueue.tail
+		m.sent = nano
+		r.inflight += m.buf.Len()
+		if r.cc != nil {
+			r.cc.OnSend(m.buf.Len(), nano)
 		}
-		r.sendQueue.head = nil
-		r.sendQueue.tail = nil
+		r.sendHistory.push(m)
 	}
 }
 func (r *Rudp) clearSendExpired() {
-	m := r.sendHistory.head
-	for m != nil {
+	for m := r.sendHistory.head; m != nil; m = r.sendHistory.head {
 		if m.tick >= r.lastExpiredTick {
 			break
 		}
-		m = m.next
-	}
-	r.sendHistory.head = m
-	if m == nil {
-		r.sendHistory.tail = nil
+		r.sendHistory.pop(-1)
+		r.inflight -= m.buf.Len()
 	}
 }
 
+// addRequest queues a request for the messages sent and not acknowledged
+// between min and max,the rest of the range is dropped.
 func (r *Rudp) addRequest(min, max int) {
-	dbg("add request %v-%v,max send id %v", min, max, r.sendID)
-	r.addSendAgain <- [2]int{min, max}
+	r.dbg("add request %v-%v,max send id %v", min, max, r.sendID)
+	sent := r.sendID
+	if r.sendQueue.head != nil {
+		sent = r.sendQueue.head.id
+	}
+	if max >= sent {
+		max = sent - 1
+	}
+	if min < r.sendAckID {
+		min = r.sendAckID
+	}
+	if min > max {
+		r.dbg("drop request %v-%v,ack %v,sent %v", min, max, r.sendAckID, sent)
+		return
+	}
+	select {
+	case r.addSendAgain <- [2]int{min, max}:
+	default:
+		r.dbg("add request %v-%v,queue full", min, max)
+	}
+}
+
+// addAck drops the sent messages before id,the remote has received them,
+// and can receive wnd more messages after them
+func (r *Rudp) addAck(id, wnd int) {
+	if id < r.sendAckID || id > r.sendID {
+		return
+	}
+	if id+wnd > r.sendLimit {
+		r.sendLimit = id + wnd
+	}
+	if id == r.sendAckID {
+		return
+	}
+	r.sendAckID = id
+	r.sendBackoff = 0
+	var bytes int
+	for r.sendHistory.head != nil && r.sendHistory.head.id < id {
+		bytes += r.sendHistory.pop(-1).buf.Len()
+	}
+	r.inflight -= bytes
+	if r.cc != nil {
+		r.cc.OnAck(bytes, r.rtt, time.Now().UnixNano())
+	}
+}
+
+// ackRecv tells the remote every message before the first missing one
+// has arrived and how many more it can send,after any message was received
+// or read since last time,or TIME_INTERVAL passed in case it was lost
+func (r *Rudp) ackRecv(tmp *packageBuffer) {
+	nano := time.Now().UnixNano()
+	if !r.recvAck && nano < r.ackSent+TIME_INTERVAL {
+		return
+	}
+	r.recvAck, r.ackSent = false, nano
+	id := r.recvIDMin
+	for m := r.recvQueue.head; m != nil && m.id == id; m = m.next {
+		id++
+	}
+	wnd := r.conf.Window - r.recvQueue.num
+	if wnd < 0 {
+		wnd = 0
+	}
+	tmp.packAck(id, wnd)
 }
 
 func (r *Rudp) addMissing(min, max int) {
 	if max < r.recvIDMin {
-		dbg("add missing %v-%v fail,already recv,min %v", min, max, r.recvIDMin)
+		r.dbg("add missing %v-%v fail,already recv,min %v", min, max, r.recvIDMin)
 		return
 	}
 	if min > r.recvIDMin {
-		dbg("add missing %v-%v fail, more than min %v", min, max, r.recvIDMin)
+		r.dbg("add missing %v-%v fail, more than min %v", min, max, r.recvIDMin)
 		return
 	}
 	head := 0
 	if r.recvQueue.head != nil {
 		head = r.recvQueue.head.id
 	}
-	dbg("add missing %v-%v,min %v,head %v", min, max, r.recvIDMin, head)
+	r.dbg("add missing %v-%v,min %v,head %v", min, max, r.recvIDMin, head)
+	delete(r.recvSkip, r.recvIDMin)
 	r.recvIDMin = max + 1
 	r.checkMissing(true)
 }
 
+// replyRequest sends again the messages requested,at most REQUEST_MAX_NUM
+// for one request and MaxResendSize byte every TIME_INTERVAL with the
+// resend timeouts,the remote requests the rest again later.
 func (r *Rudp) replyRequest(tmp *packageBuffer) {
+	if nano := time.Now().UnixNano(); nano >= r.resendStart+TIME_INTERVAL {
+		r.resendStart, r.resendSize = nano, 0
+	}
 	for {
 		select {
 		case again := <-r.addSendAgain:
+			nano := time.Now().UnixNano()
+			if r.cc != nil {
+				r.cc.OnLoss(false, r.rtt, nano)
+			}
 			history := r.sendHistory.head
 			min, max := again[0], again[1]
 			if history == nil || max < history.id {
-				dbg("send again miss %v-%v,send max %v", min, max, r.sendID)
+				r.dbg("send again miss %v-%v,send max %v", min, max, r.sendID)
 				tmp.packRequest(min, max, TYPE_MISSING)
 			} else {
 				var start, end, num int
@@ -424,8 +899,14 @@ func (r *Rudp) replyRequest(tmp *packageBuffer) {
 						//expired
 						break
 					} else if min <= history.id {
+						if num >= REQUEST_MAX_NUM || r.resendSize >= r.conf.MaxResendSize {
+							r.dbg("send again limit,num %v,size %v", num, r.resendSize)
+							break
+						}
 						tmp.packMessage(history)
-						if start == 0 {
+						r.resendSize += history.buf.Len()
+						history.sent = nano
+						if num == 0 {
 							start = history.id
 						}
 						end = history.id
@@ -435,9 +916,9 @@ func (r *Rudp) replyRequest(tmp *packageBuffer) {
 				}
 				if min < start {
 					tmp.packRequest(min, start-1, TYPE_MISSING)
-					dbg("send again miss %v-%v,send max %v", min, start-1, r.sendID)
+					r.dbg("send again miss %v-%v,send max %v", min, start-1, r.sendID)
 				}
-				dbg("send again %v-%v of %v-%v,all %v,max send id %v", start, end, min, max, num, r.sendID)
+				r.dbg("send again %v-%v of %v-%v,all %v,max send id %v", start, end, min, max, num, r.sendID)
 			}
 		default:
 			return
@@ -445,6 +926,92 @@ func (r *Rudp) replyRequest(tmp *packageBuffer) {
 	}
 }
 
+// resendTimeout sends again the oldest message not acknowledged in time,
+// and the newest as a tail loss probe,so the last messages of a burst
+// arrive even if nothing is sent after them. The remote requests the ones
+// between,it has most of them and can not acknowledge them before the
+// oldest. The timeout doubles every time until an acknowledgement comes,
+// and waits the next TIME_INTERVAL if MaxResendSize is used up.
+func (r *Rudp) resendTimeout(tmp *packageBuffer) {
+	nano := time.Now().UnixNano()
+	timeout := r.rto << r.sendBackoff
+	var num int
+	for _, m := range []*message{r.sendHistory.head, r.sendHistory.tail} {
+		if m != nil && m.sent+timeout <= nano && r.resendSize < r.conf.MaxResendSize {
+			tmp.packMessage(m)
+			r.resendSize += m.buf.Len()
+			m.sent = nano
+			num++
+		}
+	}
+	if num > 0 {
+		r.dbg("resend timeout %v,num %v,ack %v,max send id %v", timeout, num, r.sendAckID, r.sendID)
+		if r.cc != nil {
+			r.cc.OnLoss(true, r.rtt, nano)
+		}
+		if r.sendBackoff < 6 {
+			r.sendBackoff++
+		}
+		r.checkBlackHole()
+	}
+}
+
+// sendTime sends the local time every TIME_INTERVAL,and echoes the remote
+// time plus how long it was held here,so both sides measure rtt.
+func (r *Rudp) sendTime(tmp *packageBuffer) {
+	nano := time.Now().UnixNano()
+	if r.echo {
+		r.echo = false
+		tmp.packTime(TYPE_TIME_ECHO, r.timeEcho+uint32((nano-r.timeRecv)/1e3))
+	}
+	if nano >= r.timeSent+TIME_INTERVAL {
+		r.timeSent = nano
+		tmp.packTime(TYPE_TIME, uint32(nano/1e3))
+	}
+}
+
+// addRTT updates rtt by a echoed time like RFC 6298,the clock granularity
+// is the output interval.
+func (r *Rudp) addRTT(us uint32) {
+	rtt := int64(int32(uint32(time.Now().UnixNano()/1e3)-us)) * 1e3
+	if rtt < -1e6 || rtt > 60e9 {
+		return
+	} else if rtt < 1e3 {
+		rtt = 1e3 //rounded to microsecond on both sides
+	}
+	if r.rtt == 0 {
+		r.rtt, r.rttVar = rtt, rtt/2
+	} else {
+		diff := r.rtt - rtt
+		if diff < 0 {
+			diff = -diff
+		}
+		r.rttVar = (3*r.rttVar + diff) / 4
+		r.rtt = (7*r.rtt + rtt) / 8
+	}
+	granularity := int64(r.conf.SendTick) * int64(r.conf.SendDelayTick)
+	if granularity < 4*r.rttVar {
+		granularity = 4 * r.rttVar
+	}
+	r.rto = r.rtt + granularity
+	r.missing = r.rtt / 4
+}
+
+// BadPackages returns how many packages were dropped because the checksum
+// did not match.
+func (r *Rudp) BadPackages() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.badPackages
+}
+
+// RTT returns the smoothed round trip time,0 before it is measured.
+func (r *Rudp) RTT() time.Duration {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return time.Duration(r.rtt)
+}
+
 func (r *Rudp) reqMissing(tmp *packageBuffer) {
 	for {
 		select {
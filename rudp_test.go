@@ -1,8 +1,18 @@
 package rudp
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"log"
 	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func Test_bitShow(t *testing.T) {
@@ -57,7 +67,7 @@ func Test_Rudp(t *testing.T) {
 	if udp.Update(0) != nil {
 		t.Errorf("update 0 return error")
 	}
-	pkg := udp.Update(sendDelayTick)
+	pkg := udp.Update(udp.conf.SendDelayTick)
 	sendLen := func(p *Package) (sz int) {
 		for p != nil {
 			sz += len(p.Bts)
@@ -69,13 +79,13 @@ func Test_Rudp(t *testing.T) {
 		t.Errorf("out pkg t1,t2 length error,out %v,realy %v",
 			sendLen(pkg), len(t1)+3+len(t2)+3)
 	}
-	pkg = udp.Update(sendDelayTick)
+	pkg = udp.Update(udp.conf.SendDelayTick)
 	if pkg == nil || len(pkg.Bts) != 1 {
 		t.Errorf("ping error,pkg %v", pkg)
 	}
 	send(t3)
 	send(t4)
-	pkg = udp.Update(sendDelayTick)
+	pkg = udp.Update(udp.conf.SendDelayTick)
 	if sendLen(pkg) != len(t3)+4+len(t4)+3 {
 		t.Errorf("out pkg t3,t4 length error,out %v,realy %v",
 			sendLen(pkg), len(t3)+4+len(t4)+3)
@@ -83,7 +93,7 @@ func Test_Rudp(t *testing.T) {
 
 	r1 := []byte{TYPE_REQUEST, 00, 00, 00, 00, TYPE_REQUEST, 00, 03, 00, 03}
 	udp.Input(r1)
-	pkg = udp.Update(sendDelayTick)
+	pkg = udp.Update(udp.conf.SendDelayTick)
 	if sendLen(pkg) != len(t1)+3+len(t4)+3 {
 		t.Errorf("miss out pkg t1,t4 length error,out %v,realy %v",
 			sendLen(pkg), len(t1)+3+len(t4)+3)
@@ -144,3 +154,1208 @@ func Test_RudpConn(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func newTestConn(t *testing.T, conf ...Config) (*RudpListener, *RudpConn) {
+	sconn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cconn, err := net.DialUDP("udp", nil, sconn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewListener(sconn, conf...), NewConn(cconn, New(conf...))
+}
+
+func Test_RudpConnDeadline(t *testing.T) {
+	listener, rconn := newTestConn(t)
+	defer listener.Close()
+	defer rconn.Close()
+
+	rconn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err := rconn.Read(make([]byte, 10))
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read deadline error %v", err)
+	}
+	if _, err := rconn.Read(make([]byte, 10)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expired deadline error %v", err)
+	}
+
+	start := time.Now()
+	rconn.SetReadDeadline(start.Add(50 * time.Millisecond))
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		rconn.SetReadDeadline(start.Add(200 * time.Millisecond))
+	}()
+	if _, err := rconn.Read(make([]byte, 10)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("extended deadline error %v", err)
+	}
+	if d := time.Since(start); d < 150*time.Millisecond {
+		t.Fatalf("extended deadline return after %v", d)
+	}
+
+	rconn.SetReadDeadline(time.Time{})
+	rconn.SetWriteDeadline(time.Now().Add(-time.Second))
+	if n, err := rconn.Write([]byte{1}); n != 0 || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("write deadline n %v,error %v", n, err)
+	}
+}
+
+func Test_RudpConnMessage(t *testing.T) {
+	listener, rconn := newTestConn(t)
+	defer listener.Close()
+	defer rconn.Close()
+
+	big := make([]byte, 4*MAX_FRAGMENT+10)
+	for i := range big {
+		big[i] = byte(i)
+	}
+	small := []byte("hello")
+	for _, msg := range [][]byte{big, small, big[:MAX_FRAGMENT], big[:MAX_FRAGMENT+1]} {
+		if n, err := rconn.Write(msg); n != len(msg) || err != nil {
+			t.Fatalf("write n %v,error %v", n, err)
+		}
+	}
+	sconn, err := listener.AcceptRudp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sconn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data := make([]byte, 2*len(big))
+	for _, msg := range [][]byte{big, small, big[:MAX_FRAGMENT], big[:MAX_FRAGMENT+1]} {
+		n, err := sconn.Read(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data[:n], msg) {
+			t.Fatalf("read message length %v,want %v", n, len(msg))
+		}
+	}
+}
+
+func Test_RudpConnStream(t *testing.T) {
+	conf := DefaultConfig()
+	conf.StreamMode = true
+	listener, rconn := newTestConn(t, conf)
+	defer listener.Close()
+	defer rconn.Close()
+
+	msg := make([]byte, 3*MAX_FRAGMENT+10)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	rconn.Write(msg[:100])
+	rconn.Write(msg[100:])
+	sconn, err := listener.AcceptRudp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sconn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data := make([]byte, len(msg))
+	if _, err := io.ReadFull(bufio.NewReaderSize(sconn, 16), data); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, msg) {
+		t.Fatalf("stream read error")
+	}
+}
+
+func Test_RudpConnShortBuffer(t *testing.T) {
+	listener, rconn := newTestConn(t)
+	defer listener.Close()
+	defer rconn.Close()
+
+	rconn.Write([]byte("hello"))
+	sconn, err := listener.AcceptRudp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sconn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data := make([]byte, 3)
+	if n, err := sconn.Read(data); n != 3 || err != io.ErrShortBuffer {
+		t.Fatalf("short read n %v,error %v", n, err)
+	}
+}
+
+func deliver(p *Package, to *Rudp) {
+	for ; p != nil; p = p.Next {
+		to.Input(p.Bts)
+	}
+}
+
+func Test_RudpAck(t *testing.T) {
+	a, b := New(), New()
+	a.Send([]byte{1})
+	a.Send([]byte{2})
+	a.Send([]byte{3})
+	deliver(a.Update(1), b)
+	if a.sendHistory.head == nil {
+		t.Fatalf("history cleared before ack")
+	}
+	deliver(b.Update(1), a)
+	if a.sendHistory.head != nil || a.sendAckID != 3 {
+		t.Fatalf("history not cleared by ack %v", a.sendAckID)
+	}
+	if pkg := b.Update(1); pkg == nil || len(pkg.Bts) != 1 || pkg.Bts[0] != TYPE_PING {
+		t.Fatalf("ack again without new message %v", pkg)
+	}
+}
+
+func Test_RudpResend(t *testing.T) {
+	conf := DefaultConfig()
+	conf.ResendTime = 1e6
+	a, b := New(conf), New(conf)
+	a.Send([]byte{1})
+	a.Send([]byte{2})
+	a.Update(1) //lost
+	if pkg := a.Update(1); pkg == nil || len(pkg.Bts) != 1 {
+		t.Fatalf("resend before timeout %v", pkg)
+	}
+	time.Sleep(2 * time.Millisecond)
+	deliver(a.Update(1), b)
+	data := make([]byte, 10)
+	for _, want := range []byte{1, 2} {
+		if n, err := b.Recv(data); n != 1 || err != nil || data[0] != want {
+			t.Fatalf("recv resend n %v,error %v,data %v", n, err, data[:n])
+		}
+	}
+	deliver(b.Update(1), a)
+	if a.sendHistory.head != nil || a.sendBackoff != 0 {
+		t.Fatalf("resend not acknowledged")
+	}
+
+	//the timeout sends the oldest and the newest of a lost burst,the
+	//remote requests the ones between
+	conf.MissingTime = 1e6
+	a, b = New(conf), New(conf)
+	for i := 0; i < 6; i++ {
+		a.Send([]byte{byte(i)})
+	}
+	a.Update(1) //lost
+	time.Sleep(2 * time.Millisecond)
+	deliver(a.Update(1), b)
+	if n, _ := b.Recv(data); n != 1 || data[0] != 0 {
+		t.Fatalf("recv oldest %v", data[:n])
+	}
+	if n, _ := b.Recv(data); n != 0 || b.recvQueue.num != 1 || b.recvQueue.head.id != 5 {
+		t.Fatalf("resend %v more,queue %v", n, b.recvQueue.num)
+	}
+	for i := 0; i < 2; i++ {
+		b.Input([]byte{TYPE_PING}) //finds the gap,and requests it after MissingTime
+		time.Sleep(2 * time.Millisecond)
+	}
+	deliver(b.Update(1), a)
+	deliver(a.Update(1), b)
+	for want := byte(1); want < 6; want++ {
+		if n, err := b.Recv(data); n != 1 || err != nil || data[0] != want {
+			t.Fatalf("recv requested n %v,error %v,data %v", n, err, data[:n])
+		}
+	}
+}
+
+func Test_RudpRTT(t *testing.T) {
+	a, b := New(), New()
+	a.timeSent = 0
+	deliver(a.Update(1), b)
+	time.Sleep(20 * time.Millisecond)
+	deliver(b.Update(1), a)
+	if rtt := a.RTT(); rtt <= 0 || rtt >= 10*time.Millisecond {
+		t.Fatalf("rtt %v include the echo delay", rtt)
+	}
+	if a.rto == int64(a.conf.ResendTime) || a.missing != a.rtt/4 {
+		t.Fatalf("timer not derived from rtt,rto %v,missing %v", a.rto, a.missing)
+	}
+	if b.RTT() != 0 {
+		t.Fatalf("rtt without echo %v", b.RTT())
+	}
+}
+
+func Test_RudpCongestion(t *testing.T) {
+	msg := make([]byte, 500)
+	for _, cc := range []func() Congestion{nil, NewReno, NewBBR} {
+		conf := DefaultConfig()
+		conf.Congestion = cc
+		a, b := New(conf), New(conf)
+		a.Input([]byte{TYPE_ACK, 0, 0, 4, 0}) //the window of b
+		for i := 0; i < 1000; i++ {
+			a.Send(msg)
+		}
+		pkg := a.Update(1)
+		var num int
+		for p := pkg; p != nil; p = p.Next {
+			num++
+		}
+		if cc == nil && num < 1000 || cc != nil && num > 11 {
+			t.Fatalf("first send package num %v", num)
+		}
+		data := make([]byte, len(msg))
+		var recv int
+		for i := 0; i < 10000 && recv < 1000; i++ {
+			deliver(pkg, b)
+			for n, _ := b.Recv(data); n > 0; n, _ = b.Recv(data) {
+				recv++
+			}
+			deliver(b.Update(1), a)
+			time.Sleep(10 * time.Microsecond)
+			pkg = a.Update(1)
+		}
+		if recv != 1000 {
+			t.Fatalf("recv %v", recv)
+		}
+		deliver(b.Update(1), a)
+		if a.inflight != 0 {
+			t.Fatalf("inflight %v after all acknowledged", a.inflight)
+		}
+	}
+}
+
+func Test_RudpWindow(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Window = 4
+	a, b := New(conf), New(conf)
+	for i := 0; i < 4; i++ {
+		if _, err := a.Send([]byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := a.Send([]byte{4}); err != ErrWouldBlock {
+		t.Fatalf("send out of window error %v", err)
+	}
+	deliver(a.Update(1), b)
+	deliver(b.Update(1), a)
+	if _, err := a.Send([]byte{4}); err != ErrWouldBlock {
+		t.Fatalf("send to full remote error %v", err)
+	}
+	data := make([]byte, 1)
+	for n, _ := b.Recv(data); n > 0; n, _ = b.Recv(data) {
+	}
+	deliver(b.Update(1), a)
+	if _, err := a.Send([]byte{4}); err != nil {
+		t.Fatalf("send after window open error %v", err)
+	}
+
+	//a larger window is used after the remote tells it
+	a, b = New(), New()
+	for i := 0; i < INITIAL_WINDOW; i++ {
+		if _, err := a.Send([]byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := a.Send([]byte{0}); err != ErrWouldBlock {
+		t.Fatalf("send out of initial window error %v", err)
+	}
+	deliver(a.Update(1), b)
+	deliver(b.Update(1), a)
+	if a.sendLimit != b.conf.Window {
+		t.Fatalf("send limit %v after ack", a.sendLimit)
+	}
+}
+
+func Test_RudpSendLarge(t *testing.T) {
+	conf := DefaultConfig()
+	conf.MaxMessageSize = 10 * MAX_FRAGMENT
+	a, b := New(conf), New(conf)
+	a.Input([]byte{TYPE_ACK, 0, 0, 4, 0}) //the window of b
+	big := make([]byte, conf.MaxMessageSize)
+	for i := range big {
+		big[i] = byte(i)
+	}
+	if n, err := a.Send(big); n != len(big) || err != nil {
+		t.Fatalf("send n %v,error %v", n, err)
+	}
+	if _, err := a.Send(make([]byte, conf.MaxMessageSize+1)); err != ErrMessageTooLarge {
+		t.Fatalf("send too large error %v", err)
+	}
+	a.Send([]byte{1})
+	deliver(a.Update(1), b)
+	data := make([]byte, len(big))
+	if n, err := b.Recv(data[:10]); n != 10 || err != io.ErrShortBuffer {
+		t.Fatalf("recv short n %v,error %v", n, err)
+	}
+	if n, _ := b.Recv(data); n != 1 {
+		t.Fatalf("recv n %v", n)
+	}
+
+	a.Send(big)
+	for i := 0; i < 5; i++ {
+		deliver(b.Update(1), a) //ack,the congestion window is smaller than big
+		deliver(a.Update(1), b)
+	}
+	if n, err := b.Recv(data); err != nil || !bytes.Equal(data[:n], big) {
+		t.Fatalf("recv n %v,error %v", n, err)
+	}
+
+	listener, rconn := newTestConn(t, conf)
+	defer listener.Close()
+	defer rconn.Close()
+	if _, err := rconn.Write(make([]byte, conf.MaxMessageSize+1)); err != ErrMessageTooLarge {
+		t.Fatalf("write too large error %v", err)
+	}
+}
+
+func Test_RudpRequestLimit(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Congestion = nil
+	conf.ResendTime = 2e9
+	newRudp := func() *Rudp {
+		r := New(conf)
+		r.Input([]byte{TYPE_ACK, 0, 0, 4, 0}) //the window of the remote
+		for i := 0; i < 600; i++ {
+			r.Send([]byte{byte(i)})
+		}
+		r.Update(1)
+		return r
+	}
+	//every message takes 4 byte,the rest of the output is less than 30
+	output := func(r *Rudp) (n int) {
+		for p := r.Update(1); p != nil; p = p.Next {
+			n += len(p.Bts)
+		}
+		return
+	}
+	request := func(r *Rudp, min, max int) int {
+		r.Input([]byte{TYPE_REQUEST, byte(min >> 8), byte(min), byte(max >> 8), byte(max)})
+		return output(r)
+	}
+	a := newRudp()
+	if n := request(a, 0, 599); n < 4*REQUEST_MAX_NUM || n > 4*REQUEST_MAX_NUM+30 {
+		t.Fatalf("send again %v byte for one request", n)
+	}
+	if n := request(a, 600, 0xffff); n > 30 {
+		t.Fatalf("send again %v byte for messages never sent", n)
+	}
+	a.Input([]byte{TYPE_ACK, 0, 100, 4, 0})
+	if n := request(a, 0, 99); n > 30 {
+		t.Fatalf("send again %v byte for acknowledged messages", n)
+	}
+
+	conf.MaxResendSize = 40
+	b := newRudp()
+	if n := request(b, 0, 599); n < 4*40 || n > 4*40+30 {
+		t.Fatalf("send again %v byte in limit 40", n)
+	}
+	if n := request(b, 0, 599); n > 30 {
+		t.Fatalf("send again %v byte over limit", n)
+	}
+	time.Sleep(TIME_INTERVAL)
+	if n := request(b, 0, 599); n < 4*40 {
+		t.Fatalf("send again %v byte in next interval", n)
+	}
+
+	//resend timeouts count in the same limit
+	conf.ResendTime = 1e6
+	c := newRudp()
+	request(c, 0, 599)
+	time.Sleep(2 * time.Millisecond)
+	if n := output(c); n >= 4 {
+		t.Fatalf("resend timeout %v byte over limit", n)
+	}
+	time.Sleep(TIME_INTERVAL)
+	if n := output(c); n < 2*4 {
+		t.Fatalf("resend timeout %v byte in next interval", n)
+	}
+}
+
+func Test_RudpWideID(t *testing.T) {
+	if id := New().getID(0x9000, []byte{0, 0}); id != 0x10000 {
+		t.Fatalf("16 bit id %#x", id)
+	}
+	a, b := New(), New()
+	a.Negotiate(PROTOCOL_VERSION, FEATURE_WIDE_ID)
+	b.Negotiate(PROTOCOL_VERSION, FEATURE_WIDE_ID)
+	if id := a.getID(0x9000, []byte{0, 0, 0, 0}); id != 0 {
+		t.Fatalf("32 bit id %#x", id)
+	}
+	if strconv.IntSize == 64 {
+		wrap := int64(1) << 32 //not a constant,so it builds on 32 bit
+		if id := a.getID(int(wrap-0x10), []byte{0, 0, 0, 5}); int64(id) != wrap+5 {
+			t.Fatalf("id after 32 bit wrap %#x", id)
+		}
+		if id := a.getID(int(wrap+5), []byte{0xff, 0xff, 0xff, 0xf0}); int64(id) != wrap-0x10 {
+			t.Fatalf("id before 32 bit wrap %#x", id)
+		}
+	}
+	//ids far behind or ahead of the last one
+	start := 1 << 20
+	a.sendID, a.sendAckID, a.sendLimit = start, start, start+a.conf.Window
+	b.recvIDMin, b.recvIDMax = start, start-0x9000
+	for i := 0; i < 3; i++ {
+		a.Send([]byte{byte(i)})
+	}
+	deliver(a.Update(1), b)
+	deliver(b.Update(1), a)
+	data := make([]byte, 1)
+	for i := 0; i < 3; i++ {
+		if n, err := b.Recv(data); n != 1 || err != nil || data[0] != byte(i) {
+			t.Fatalf("recv %v,%v,%v", n, err, data)
+		}
+	}
+	if a.sendAckID != start+3 {
+		t.Fatalf("ack %#x,want %#x", a.sendAckID, start+3)
+	}
+
+	listener, rconn := newTestConn(t)
+	defer listener.Close()
+	defer rconn.Close()
+	rconn.Write([]byte("wide"))
+	sconn, err := listener.AcceptRudp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sconn.Close()
+	idSize := func(r *Rudp) int {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		return r.idSize
+	}
+	if idSize(rconn.rudp) != 4 || idSize(sconn.rudp) != 4 {
+		t.Fatalf("negotiated id size %v,%v", idSize(rconn.rudp), idSize(sconn.rudp))
+	}
+}
+
+func Test_RudpVersion(t *testing.T) {
+	r := New()
+	if v, f := r.Version(); v != VERSION_0 || f != 0 {
+		t.Fatalf("new rudp version %v,features %v", v, f)
+	}
+	r.Negotiate(PROTOCOL_VERSION+1, 0xff)
+	if v, f := r.Version(); v != PROTOCOL_VERSION || f != FEATURES {
+		t.Fatalf("newer remote version %v,features %v", v, f)
+	}
+
+	old := DefaultConfig()
+	old.Version = VERSION_0
+	noWide := DefaultConfig()
+	noWide.Features = 0
+	for _, c := range []struct {
+		client, server  Config
+		version, idSize int
+	}{
+		{DefaultConfig(), DefaultConfig(), PROTOCOL_VERSION, 4},
+		{old, DefaultConfig(), VERSION_0, 2},
+		{DefaultConfig(), old, VERSION_0, 2},
+		{noWide, DefaultConfig(), PROTOCOL_VERSION, 2},
+	} {
+		sconn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cconn, err := net.DialUDP("udp", nil, sconn.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		listener, rconn := NewListener(sconn, c.server), NewConn(cconn, New(c.client))
+		rconn.Write([]byte("version"))
+		aconn, err := listener.AcceptRudp()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := make([]byte, 10)
+		aconn.SetReadDeadline(time.Now().Add(time.Second))
+		if n, err := aconn.Read(data); err != nil || string(data[:n]) != "version" {
+			t.Fatalf("read %q,%v", data[:n], err)
+		}
+		for _, conn := range []*RudpConn{rconn, aconn} {
+			conn.rudp.lock.Lock()
+			v, idSize := conn.rudp.version, conn.rudp.idSize
+			conn.rudp.lock.Unlock()
+			if v != c.version || idSize != c.idSize {
+				t.Fatalf("client %v,server %v negotiate version %v,id size %v",
+					c.client.Version, c.server.Version, v, idSize)
+			}
+		}
+		rconn.Close()
+		aconn.Close()
+		listener.Close()
+	}
+}
+
+func Test_RudpChecksum(t *testing.T) {
+	a, b := New(), New()
+	a.Negotiate(PROTOCOL_VERSION, FEATURES)
+	b.Negotiate(PROTOCOL_VERSION, FEATURES)
+	a.Send([]byte{1, 2, 3, 4})
+	p := a.Update(1)
+	for _, i := range []int{0, len(p.Bts) - 1} {
+		bad := append([]byte(nil), p.Bts...)
+		bad[i] ^= 0x80
+		b.Input(bad)
+	}
+	b.Input(p.Bts[:2])
+	data := make([]byte, 10)
+	if n, err := b.Recv(data); n != 0 || err != nil || b.BadPackages() != 3 {
+		t.Fatalf("bad package recv %v,%v,bad num %v", n, err, b.BadPackages())
+	}
+	deliver(p, b)
+	if n, err := b.Recv(data); n != 4 || err != nil || b.BadPackages() != 3 {
+		t.Fatalf("recv %v,%v,bad num %v", n, err, b.BadPackages())
+	}
+}
+
+func Test_RudpPMTU(t *testing.T) {
+	conf := DefaultConfig()
+	conf.CorruptTick = 1e4
+	a, b := New(conf), New(conf)
+	a.Input([]byte{TYPE_ACK, 0, 0, 4, 0}) //the window of b
+	var path int
+	//every exchange is after the timeouts of a,nothing depends on the clock
+	exchange := func() {
+		a.timeSent = 0
+		if a.probeSent != 0 {
+			a.probeSent = 1
+		}
+		for m := a.sendHistory.head; m != nil; m = m.next {
+			m.sent = 0
+		}
+		for _, d := range [][2]*Rudp{{a, b}, {b, a}} {
+			for p := d[0].Update(1); p != nil; p = p.Next {
+				if len(p.Bts) <= path {
+					d[1].Input(p.Bts)
+				}
+			}
+		}
+	}
+	wait := func(pmtu int) {
+		for i := 0; i < 100 && a.PMTU() != pmtu; i++ {
+			exchange()
+		}
+		if a.PMTU() != pmtu {
+			t.Fatalf("pmtu %v,want %v", a.PMTU(), pmtu)
+		}
+	}
+
+	path = 1000
+	wait(path)
+
+	//the acknowledgements of small resends do not hide the black hole
+	path = GENERAL_PACKAGE
+	for i := 0; i < 10; i++ {
+		a.Send(make([]byte, 100))
+	}
+	wait(GENERAL_PACKAGE)
+	data := make([]byte, 100)
+	for i := 0; i < 10; i++ {
+		n, err := b.Recv(data)
+		for j := 0; n == 0 && err == nil && j < 100; n, err = b.Recv(data) {
+			exchange()
+			j++
+		}
+		if n != len(data) || err != nil {
+			t.Fatalf("recv %v,%v", n, err)
+		}
+	}
+}
+
+func Test_RudpConnBackpressure(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Window = 4
+	conf.Linger = 100 * time.Millisecond //nothing is read,close can not flush
+	listener, rconn := newTestConn(t, conf)
+	defer listener.Close()
+	defer rconn.Close()
+
+	rconn.SetWriteDeadline(time.Now().Add(500 * time.Millisecond))
+	var num int
+	for ; num < 100; num++ {
+		if _, err := rconn.Write([]byte{1}); err != nil {
+			if !errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Fatal(err)
+			}
+			break
+		}
+	}
+	if num >= 100 {
+		t.Fatalf("write not blocked by a slow reader")
+	}
+}
+
+func Test_RudpListenerHandshake(t *testing.T) {
+	sconn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := NewListener(sconn)
+	defer listener.Close()
+	raw, err := net.DialUDP("udp", nil, sconn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	conns := func() int {
+		time.Sleep(50 * time.Millisecond)
+		listener.lock.RLock()
+		defer listener.lock.RUnlock()
+		return len(listener.rudpConnMap)
+	}
+
+	raw.Write(packPacket(PACKET_DATA, 1234, []byte{TYPE_PING}))
+	if n := conns(); n != 0 {
+		t.Fatalf("stray packet create %v conn", n)
+	}
+	data := make([]byte, MAX_PACKAGE)
+	read := func() (byte, uint32, []byte) {
+		raw.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := raw.Read(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		kind, session, body, _ := unpackPacket(data[:n])
+		return kind, session, body
+	}
+	forged := make([]byte, PACKET_COOKIE)
+	forged[3] = 1
+	var cookie []byte
+	for _, c := range [][]byte{nil, forged} {
+		raw.Write(packPacket(PACKET_SYN, 0, packSyn(7, c)))
+		kind, _, body := read()
+		if kind != PACKET_RETRY {
+			t.Fatalf("syn without cookie get %v", kind)
+		}
+		if n := conns(); n != 0 {
+			t.Fatalf("syn without cookie create %v conn", n)
+		}
+		_, cookie, _ = unpackSyn(body)
+	}
+	raw.Write(packPacket(PACKET_SYN, 0, packSyn(7, cookie)))
+	kind, session, body := read()
+	if nonce, _ := unpackNonce(body); kind != PACKET_SYN_ACK || session == 0 || nonce != 7 {
+		t.Fatalf("syn ack kind %v,session %v,nonce %v", kind, session, nonce)
+	}
+	if len(body) != PACKET_NONCE {
+		t.Fatalf("old syn get version %v", body[PACKET_NONCE:])
+	}
+	//the client restarts on the same address,the old conn is dropped at once
+	raw.Write(packPacket(PACKET_SYN, 0, packSyn(8, nil)))
+	_, _, body = read()
+	_, cookie, _ = unpackSyn(body)
+	raw.Write(packPacket(PACKET_SYN, 0, packSyn(8, cookie)))
+	old := session
+	kind, session, body = read()
+	if nonce, _ := unpackNonce(body); kind != PACKET_SYN_ACK || session == old || nonce != 8 {
+		t.Fatalf("restart syn ack kind %v,session %v,nonce %v", kind, session, nonce)
+	}
+	if n := conns(); n != 1 {
+		t.Fatalf("restart left %v conn", n)
+	}
+	raw.Write(packPacket(PACKET_DATA, session+1, []byte{TYPE_PING}))
+	if n := conns(); n != 1 || len(listener.newRudpConn) != 0 {
+		t.Fatalf("stale session conn %v,accept %v", n, len(listener.newRudpConn))
+	}
+	raw.Write(packPacket(PACKET_DATA, session, []byte{TYPE_PING}))
+	if conns(); len(listener.newRudpConn) != 1 {
+		t.Fatalf("session not accepted")
+	}
+}
+
+func Test_RudpConnHandshakeTimeout(t *testing.T) {
+	sconn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sconn.Close()
+	cconn, err := net.DialUDP("udp", nil, sconn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := DefaultConfig()
+	conf.HandshakeTimeout = 100 * time.Millisecond
+	rconn := NewConn(cconn, New(conf))
+	rconn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := rconn.Read(make([]byte, 1)); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("handshake timeout error %v", err)
+	}
+}
+
+func Test_RudpConnEncrypt(t *testing.T) {
+	client, server := newCrypt([]byte("key"), 1, 2, false), newCrypt([]byte("key"), 1, 2, true)
+	p := client.seal(PACKET_DATA, 1, []byte("plain text"))
+	if bytes.Contains(p, []byte("plain")) {
+		t.Fatalf("plain text on the wire")
+	}
+	if bts, ok := server.open(p); !ok || string(bts) != "plain text" {
+		t.Fatalf("open %q,%v", bts, ok)
+	}
+	if _, ok := client.open(p); ok {
+		t.Fatalf("open the packet of own direction")
+	}
+	if _, ok := newCrypt([]byte("other"), 1, 2, true).open(p); ok {
+		t.Fatalf("open with other key")
+	}
+	for _, i := range []int{1, PACKET_HEAD, len(p) - 1} {
+		bad := append([]byte(nil), p...)
+		bad[i] ^= 1
+		if _, ok := server.open(bad); ok {
+			t.Fatalf("open packet changed at %v", i)
+		}
+	}
+
+	conf := DefaultConfig()
+	conf.Key = []byte("secret")
+	conf.Linger = 0
+	listener, rconn := newTestConn(t, conf)
+	defer listener.Close()
+	defer rconn.Close()
+	rconn.Write([]byte("hello"))
+	sconn, err := listener.AcceptRudp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sconn.Close()
+	data := make([]byte, 10)
+	sconn.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := sconn.Read(data); err != nil || string(data[:n]) != "hello" {
+		t.Fatalf("read %q,%v", data[:n], err)
+	}
+
+	//packets not sealed by the key do not start a path challenge
+	attacker, err := net.DialUDP("udp", nil, listener.Addr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer attacker.Close()
+	for _, kind := range []byte{PACKET_SYN_ACK, PACKET_CHALLENGE, PACKET_RETRY, PACKET_DATA} {
+		attacker.Write(packPacket(kind, sconn.session, make([]byte, CRYPT_NUMBER+CRYPT_TAG+PACKET_PATH)))
+	}
+	attacker.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := attacker.Read(make([]byte, MAX_PACKAGE)); err == nil {
+		t.Fatalf("unauthentic packet get %v bytes", n)
+	}
+	attacker.Write(packPacket(PACKET_RESPONSE, sconn.session, make([]byte, PACKET_PATH)))
+	time.Sleep(50 * time.Millisecond)
+	if sconn.RemoteAddr().String() != rconn.LocalAddr().String() {
+		t.Fatalf("migrate to %v without the key", sconn.RemoteAddr())
+	}
+
+	wrong := conf
+	wrong.Key = []byte("wrong")
+	cconn, err := net.DialUDP("udp", nil, listener.Addr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wconn := NewConn(cconn, New(wrong))
+	defer wconn.Close()
+	wconn.Write([]byte("hello"))
+	time.Sleep(200 * time.Millisecond)
+	if n := len(listener.newRudpConn); n != 0 {
+		t.Fatalf("accept %v conn of wrong key", n)
+	}
+
+	//a SYN_ACK without the tag of the key does not set the session
+	fake, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fake.Close()
+	dial, err := net.DialUDP("udp", nil, fake.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	victim := NewConn(dial, New(conf))
+	defer victim.Close()
+	buf := make([]byte, MAX_PACKAGE)
+	fake.SetReadDeadline(time.Now().Add(time.Second))
+	n, addr, err := fake.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, body, _ := unpackPacket(buf[:n])
+	nonce, _, _ := unpackSyn(body)
+	ack := append(packNonce(nonce), packVersion(PROTOCOL_VERSION, FEATURES)...)
+	forged := append(ack, make([]byte, CRYPT_TAG)...)
+	fake.WriteToUDP(packPacket(PACKET_SYN_ACK, 99, forged), addr)
+	time.Sleep(50 * time.Millisecond)
+	if isClosed(victim.established) {
+		t.Fatalf("established by a forged syn ack")
+	}
+	ack = append(ack, synAckTag(conf.Key, 100, ack)...)
+	fake.WriteToUDP(packPacket(PACKET_SYN_ACK, 100, ack), addr)
+	time.Sleep(50 * time.Millisecond)
+	if !isClosed(victim.established) || atomic.LoadUint32(&victim.session) != 100 {
+		t.Fatalf("syn ack with the tag not accepted")
+	}
+}
+
+func Test_RudpReplay(t *testing.T) {
+	client, server := newCrypt([]byte("key"), 1, 2, false), newCrypt([]byte("key"), 1, 2, true)
+	var ps [][]byte
+	for i := 0; i < 4; i++ {
+		ps = append(ps, client.seal(PACKET_DATA, 1, []byte{byte(i)}))
+	}
+	forged := append([]byte(nil), ps[3]...)
+	forged[PACKET_HEAD] = 1 //number far ahead,not authentic
+	for i, c := range []struct {
+		p  []byte
+		ok bool
+	}{{ps[0], true}, {ps[2], true}, {ps[1], true}, {ps[1], false}, {ps[0], false},
+		{forged, false}, {ps[3], true}, {ps[3], false}} {
+		if _, ok := server.open(c.p); ok != c.ok {
+			t.Fatalf("open %v %v,want %v", i, ok, c.ok)
+		}
+	}
+
+	var w replayWindow
+	for n := uint64(1); n < 3*REPLAY_WINDOW; n++ {
+		if !w.check(n) {
+			t.Fatalf("drop new number %v", n)
+		}
+	}
+	max := w.max
+	if w.check(0) || w.check(max) || w.check(max-REPLAY_WINDOW) {
+		t.Fatalf("accept replayed or old number")
+	}
+	if !w.check(max+REPLAY_WINDOW) || !w.check(max+1) || w.check(max+1) {
+		t.Fatalf("window move")
+	}
+}
+
+func Test_RudpConnNoise(t *testing.T) {
+	spriv, spub, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpriv, cpub, _ := GenerateKey()
+	sconf, cconf := DefaultConfig(), DefaultConfig()
+	sconf.PrivateKey, cconf.PrivateKey = spriv, cpriv
+	sconf.Linger, cconf.Linger = 0, 0
+	sconn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := NewListener(sconn, sconf)
+	defer listener.Close()
+	dial := func(conf Config) *RudpConn {
+		cconn, err := net.DialUDP("udp", nil, sconn.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return NewConn(cconn, New(conf))
+	}
+	rconn := dial(cconf)
+	defer rconn.Close()
+	rconn.Write([]byte("hello"))
+	aconn, err := listener.AcceptRudp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer aconn.Close()
+	if !bytes.Equal(aconn.PeerPublicKey(), cpub) {
+		t.Fatalf("server get client key %x,want %x", aconn.PeerPublicKey(), cpub)
+	}
+	data := make([]byte, 10)
+	aconn.Write([]byte("noise"))
+	for _, c := range []*RudpConn{aconn, rconn} {
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		if n, err := c.Read(data); err != nil || n != 5 {
+			t.Fatalf("read %q,%v", data[:n], err)
+		}
+	}
+	if !bytes.Equal(rconn.PeerPublicKey(), spub) {
+		t.Fatalf("client get server key %x,want %x", rconn.PeerPublicKey(), spub)
+	}
+
+	plain := DefaultConfig()
+	plain.Linger = 0
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	pconn := dial(plain)
+	defer pconn.Close()
+	pconn.Write([]byte("hello"))
+	time.Sleep(200 * time.Millisecond)
+	log.SetOutput(os.Stderr)
+	if n := len(listener.newRudpConn); n != 0 {
+		t.Fatalf("accept %v conn without noise", n)
+	}
+	if bytes.Contains(logs.Bytes(), []byte(errNoise.Error())) {
+		t.Fatalf("log a failed syn without Debug")
+	}
+}
+
+func Test_RudpListenerMigration(t *testing.T) {
+	sconn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := DefaultConfig()
+	conf.CorruptTick = 1e3 //the raw clients send nothing in between
+	conf.Linger = 0
+	listener := NewListener(sconn, conf)
+	defer listener.Close()
+	dial := func() *net.UDPConn {
+		raw, err := net.DialUDP("udp", nil, sconn.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return raw
+	}
+	data := make([]byte, MAX_PACKAGE)
+	read := func(raw *net.UDPConn, want byte) []byte {
+		raw.SetReadDeadline(time.Now().Add(time.Second))
+		for {
+			n, err := raw.Read(data)
+			if err != nil {
+				t.Fatalf("wait packet %v,%v", want, err)
+			}
+			if kind, _, body, _ := unpackPacket(data[:n]); kind == want {
+				return body
+			}
+		}
+	}
+	old, cur := dial(), dial()
+	defer old.Close()
+	defer cur.Close()
+	old.Write(packPacket(PACKET_SYN, 0, packSyn(7, nil)))
+	_, cookie, _ := unpackSyn(read(old, PACKET_RETRY))
+	old.Write(packPacket(PACKET_SYN, 0, packSyn(7, cookie)))
+	read(old, PACKET_SYN_ACK)
+	listener.lock.RLock()
+	var session uint32
+	for session = range listener.rudpConnMap {
+	}
+	listener.lock.RUnlock()
+	old.Write(packPacket(PACKET_DATA, session, []byte{TYPE_PING}))
+	rconn, err := listener.AcceptRudp()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cur.Write(packPacket(PACKET_DATA, session, []byte{TYPE_PING}))
+	challenge := append([]byte(nil), read(cur, PACKET_CHALLENGE)...)
+	cur.Write(packPacket(PACKET_RESPONSE, session, make([]byte, PACKET_PATH)))
+	time.Sleep(50 * time.Millisecond)
+	if rconn.RemoteAddr().String() != old.LocalAddr().String() {
+		t.Fatalf("migrate to %v by a wrong response", rconn.RemoteAddr())
+	}
+	cur.Write(packPacket(PACKET_RESPONSE, session, challenge))
+	time.Sleep(50 * time.Millisecond)
+	if rconn.RemoteAddr().String() != cur.LocalAddr().String() {
+		t.Fatalf("remote %v,want %v", rconn.RemoteAddr(), cur.LocalAddr())
+	}
+	rconn.Write([]byte("moved"))
+	read(cur, PACKET_DATA)
+}
+
+func Test_RudpConnClose(t *testing.T) {
+	listener, rconn := newTestConn(t)
+	defer listener.Close()
+
+	big := make([]byte, 3*MAX_FRAGMENT)
+	for i := 0; i < 100; i++ {
+		rconn.Write([]byte{byte(i)})
+	}
+	rconn.Write(big)
+	if err := rconn.Close(); err != nil {
+		t.Fatalf("close error %v", err)
+	}
+	if err := rconn.Close(); err != ErrClosed {
+		t.Fatalf("close again error %v", err)
+	}
+	if _, err := rconn.Write([]byte{1}); err != ErrClosed {
+		t.Fatalf("write after close error %v", err)
+	}
+	sconn, err := listener.AcceptRudp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sconn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data := make([]byte, len(big))
+	for i := 0; i < 101; i++ {
+		n, err := sconn.Read(data)
+		if err != nil {
+			t.Fatalf("read %v error %v", i, err)
+		}
+		if i < 100 && (n != 1 || data[0] != byte(i)) || i == 100 && n != len(big) {
+			t.Fatalf("read %v,n %v", i, n)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := sconn.Read(data); err != io.EOF {
+			t.Fatalf("read after fin error %v", err)
+		}
+	}
+
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	cconn, err := net.DialUDP("udp", nil, silent.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := DefaultConfig()
+	conf.Linger = 100 * time.Millisecond
+	lonely := NewConn(cconn, New(conf))
+	lonely.Write([]byte{1})
+	if err := lonely.Close(); err != ErrTimeout {
+		t.Fatalf("close without remote error %v", err)
+	}
+
+	//the remote is gone after the handshake,nothing is acknowledged
+	gone, rconn := newTestConn(t)
+	rconn.Write([]byte{1})
+	if _, err := gone.AcceptRudp(); err != nil {
+		t.Fatal(err)
+	}
+	gone.conn.Close()
+	rconn.Write([]byte{2})
+	if err := rconn.Close(); err == nil {
+		t.Fatalf("close after remote gone without error")
+	}
+}
+
+func Test_RudpListenerClose(t *testing.T) {
+	listener, rconn := newTestConn(t)
+	defer rconn.Close()
+	rconn.Write([]byte("hello"))
+	sconn, err := listener.AcceptRudp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := make([]byte, 500)
+	for i := 0; i < 400; i++ {
+		sconn.Write(msg)
+	}
+	if err := listener.Close(); err != nil {
+		t.Fatalf("close error %v", err)
+	}
+	rconn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < 400; i++ {
+		if n, err := rconn.Read(msg); n != len(msg) || err != nil {
+			t.Fatalf("read %v,n %v,error %v", i, n, err)
+		}
+	}
+	if _, err := rconn.Read(msg); err != io.EOF {
+		t.Fatalf("read after listener close error %v", err)
+	}
+}
+
+func Test_RudpConnHalfClose(t *testing.T) {
+	listener, rconn := newTestConn(t)
+	defer listener.Close()
+	defer rconn.Close()
+
+	rconn.Write([]byte("upload"))
+	if err := rconn.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rconn.Write([]byte{1}); err != ErrClosed {
+		t.Fatalf("write after close write error %v", err)
+	}
+	sconn, err := listener.AcceptRudp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sconn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	rconn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data := make([]byte, 10)
+	if n, err := sconn.Read(data); err != nil || string(data[:n]) != "upload" {
+		t.Fatalf("read %q,error %v", data[:n], err)
+	}
+	if _, err := sconn.Read(data); err != io.EOF {
+		t.Fatalf("read after fin error %v", err)
+	}
+	sconn.Write([]byte("response"))
+	if n, err := rconn.Read(data); err != nil || string(data[:n]) != "response" {
+		t.Fatalf("read %q,error %v", data[:n], err)
+	}
+
+	sconn.CloseRead()
+	if _, err := sconn.Read(data); err != io.EOF {
+		t.Fatalf("read after close read error %v", err)
+	}
+	if err := sconn.Close(); err != nil {
+		t.Fatalf("close error %v", err)
+	}
+	if _, err := rconn.Read(data); err != io.EOF {
+		t.Fatalf("read after remote close error %v", err)
+	}
+}
+
+func Test_RudpConnLeak(t *testing.T) {
+	before := runtime.NumGoroutine()
+	data := make([]byte, 10)
+	for i := 0; i < 3; i++ {
+		listener, rconn := newTestConn(t)
+		rconn.Write([]byte("hello"))
+		sconn, err := listener.AcceptRudp()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sconn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := sconn.Read(data); err != nil {
+			t.Fatal(err)
+		}
+		rconn.Close()
+		listener.Close()
+	}
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	cconn, err := net.DialUDP("udp", nil, silent.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := DefaultConfig()
+	conf.HandshakeTimeout = 100 * time.Millisecond
+	NewConn(cconn, New(conf)) //ends by itself
+
+	for i := 0; i < 100 && runtime.NumGoroutine() > before; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		buf := make([]byte, 1<<16)
+		t.Fatalf("goroutine %v,before %v\n%s", n, before, buf[:runtime.Stack(buf, true)])
+	}
+}
+
+func Test_RudpErrors(t *testing.T) {
+	for _, err := range []error{ErrClosed, ErrRemoteClosed, ErrTimeout, ErrProtocol, ErrMessageTooLarge} {
+		nerr, ok := err.(net.Error)
+		if !ok || nerr.Timeout() != (err == ErrTimeout) {
+			t.Fatalf("%v is not a net.Error", err)
+		}
+	}
+	if _, err := New().Send(make([]byte, DefaultConfig().MaxMessageSize+1)); err != ErrMessageTooLarge {
+		t.Fatalf("send large error %v", err)
+	}
+	for _, c := range []struct {
+		in  []byte
+		err error
+	}{
+		{[]byte{TYPE_CORRUPT}, ErrRemoteClosed},
+		{[]byte{TYPE_ACK, 0}, ErrProtocol},
+	} {
+		r := New()
+		r.Input(c.in)
+		if _, err := r.Recv(make([]byte, 10)); err != c.err {
+			t.Fatalf("input %v error %v,want %v", c.in, err, c.err)
+		}
+	}
+
+	conf := DefaultConfig()
+	conf.Linger = 0
+	listener, rconn := newTestConn(t, conf)
+	defer listener.Close()
+	rconn.Write([]byte{1})
+	sconn, err := listener.AcceptRudp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sconn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data := make([]byte, 10)
+	sconn.Read(data)
+	rconn.Close()
+	if _, err := sconn.Read(data); !errors.Is(err, ErrRemoteClosed) {
+		t.Fatalf("read after abort error %v", err)
+	}
+	time.Sleep(100 * time.Millisecond) //torn down by the next tick
+	sconn.SetWriteDeadline(time.Now().Add(time.Second))
+	if _, err := sconn.Write([]byte{1}); !errors.Is(err, ErrRemoteClosed) {
+		t.Fatalf("write after abort error %v", err)
+	}
+	if err := sconn.CloseWrite(); !errors.Is(err, ErrRemoteClosed) {
+		t.Fatalf("close write after abort error %v", err)
+	}
+}
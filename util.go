@@ -5,8 +5,14 @@ import (
 	"log"
 )
 
-func dbg(format string, v ...interface{}) {
-	if debug {
+func (r *Rudp) dbg(format string, v ...interface{}) {
+	if r.conf.Debug {
+		log.Printf(format, v...)
+	}
+}
+
+func (this *RudpListener) dbg(format string, v ...interface{}) {
+	if this.conf.Debug {
 		log.Printf(format, v...)
 	}
 }